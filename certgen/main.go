@@ -0,0 +1,115 @@
+// certgen mints a small CA and client certificates for the ca, cert and key
+// options of TLSServer and TLSClient.
+//
+//	certgen -dir certs                creates certs/ca.pem and certs/ca-key.pem
+//	certgen -dir certs -name laptop   also signs certs/laptop.pem and certs/laptop-key.pem
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "Directory holding the CA and the certificates.")
+	name := flag.String("name", "", "Common name of a client certificate to sign.")
+	days := flag.Int("days", 3650, "Validity of new certificates in days.")
+	flag.Parse()
+
+	caCert := filepath.Join(*dir, "ca.pem")
+	caKey := filepath.Join(*dir, "ca-key.pem")
+	validity := time.Duration(*days) * 24 * time.Hour
+	if _, err := os.Stat(caCert); os.IsNotExist(err) {
+		template := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "SniGateway CA"},
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if err := create(caCert, caKey, template, nil, nil, validity); err != nil {
+			fatal(err)
+		}
+		fmt.Println("Created", caCert)
+	}
+	if *name == "" {
+		return
+	}
+	ca, err := tls.LoadX509KeyPair(caCert, caKey)
+	if err != nil {
+		fatal(err)
+	}
+	parent, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		fatal(err)
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert := filepath.Join(*dir, *name+".pem")
+	if err := create(cert, filepath.Join(*dir, *name+"-key.pem"), template, parent, ca.PrivateKey.(crypto.Signer), validity); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Created", cert)
+}
+
+// create writes a new key and a certificate for it made from template and
+// signed by parent, or self-signed if parent is nil.
+func create(certPath, keyPath string, template, parent *x509.Certificate, signer crypto.Signer, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validity)
+	if parent == nil {
+		parent, signer = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path, kind string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
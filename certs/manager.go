@@ -0,0 +1,183 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultCacheDir is where ACME accounts and certificates are kept unless
+// configured otherwise.
+const DefaultCacheDir = "certs"
+
+// Config describes where certificates come from.
+type Config struct {
+	// Pairs are static certificates, used for every name they are valid
+	// for.
+	Pairs []Pair
+	// Hosts may get certificates from the ACME CA at DirectoryURL, Let's
+	// Encrypt by default. DirectoryCA is a PEM file of roots to trust the
+	// CA's API with, for a test CA such as Pebble.
+	Hosts        []string
+	Email        string
+	DirectoryURL string
+	DirectoryCA  string
+	CacheDir     string
+	// HTTPAddress serves HTTP-01 challenges, for example ":80". TLS-ALPN-01
+	// challenges are always answered on the TLS listeners.
+	HTTPAddress string
+}
+
+// Manager picks a static certificate for a name if there is one, otherwise
+// gets one with ACME if the name is an allowed host, and otherwise falls
+// back to the first static certificate.
+type Manager struct {
+	store *Store
+	acme  *autocert.Manager
+
+	mu    sync.RWMutex
+	hosts map[string]bool
+
+	http *http.Server
+}
+
+// NewManager loads the static pairs of c and sets up ACME.
+func NewManager(c Config) (*Manager, error) {
+	m := &Manager{}
+	var err error
+	if m.store, err = NewStore(c.Pairs); err != nil {
+		return nil, err
+	}
+	m.SetHosts(c.Hosts)
+	cacheDir := c.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultCacheDir
+	}
+	m.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: m.hostPolicy,
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" || c.DirectoryCA != "" {
+		client := &acme.Client{DirectoryURL: c.DirectoryURL}
+		if c.DirectoryCA != "" {
+			data, err := ioutil.ReadFile(c.DirectoryCA)
+			if err != nil {
+				return nil, err
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %s", c.DirectoryCA)
+			}
+			client.HTTPClient = &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+		}
+		m.acme.Client = client
+	}
+	if c.HTTPAddress != "" {
+		m.http = &http.Server{Addr: c.HTTPAddress, Handler: m.acme.HTTPHandler(nil)}
+	}
+	return m, nil
+}
+
+// SetHosts replaces the names allowed to get certificates with ACME.
+func (m *Manager) SetHosts(hosts []string) {
+	allowed := make(map[string]bool)
+	for _, h := range hosts {
+		allowed[strings.TrimSuffix(strings.ToLower(h), ".")] = true
+	}
+	m.mu.Lock()
+	m.hosts = allowed
+	m.mu.Unlock()
+}
+
+func (m *Manager) hostPolicy(_ context.Context, host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.hosts[host] {
+		return fmt.Errorf("host %q not configured for ACME", host)
+	}
+	return nil
+}
+
+// Start watches the static certificate files and serves HTTP-01
+// challenges if configured.
+func (m *Manager) Start() error {
+	if err := m.store.Watch(); err != nil {
+		return err
+	}
+	if m.http != nil {
+		go func() {
+			if err := m.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Warningf("Serve HTTP-01 challenges failed. %s", err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+// Close stops what Start started.
+func (m *Manager) Close() {
+	m.store.Close()
+	if m.http != nil {
+		m.http.Close()
+	}
+}
+
+// GetCertificate suits tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return m.acme.GetCertificate(hello)
+		}
+	}
+	if cert := m.store.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if m.hostPolicy(hello.Context(), hello.ServerName) == nil {
+		return m.acme.GetCertificate(hello)
+	}
+	if cert := m.store.Default(); cert != nil {
+		return cert, nil
+	}
+	return nil, ErrNoCertificate
+}
+
+// TLSConfig returns a server config using the manager that negotiates
+// nextProtos and answers TLS-ALPN-01 challenges.
+func (m *Manager) TLSConfig(nextProtos ...string) *tls.Config {
+	return ServeChallenges(&tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     nextProtos,
+	})
+}
+
+// ServeChallenges makes config negotiate the TLS-ALPN-01 protocol with ACME
+// challenge handshakes only, as clients offering protocols of which the
+// server supports none would fail the handshake otherwise.
+func ServeChallenges(config *tls.Config) *tls.Config {
+	challenge := config.Clone()
+	challenge.NextProtos = []string{acme.ALPNProto}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return challenge, nil
+			}
+		}
+		return nil, nil
+	}
+	return config
+}
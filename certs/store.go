@@ -0,0 +1,181 @@
+// Package certs provides TLS certificates by SNI to TLSServer and the
+// gateway, from static certificate files that are reloaded when they change
+// on disk, and from an ACME CA such as Let's Encrypt.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("certs")
+
+// ErrNoCertificate is returned when no certificate covers a name.
+var ErrNoCertificate = errors.New("no certificate for this name")
+
+// Pair is a certificate chain file and the file of its private key.
+type Pair struct {
+	Cert string
+	Key  string
+}
+
+// Store holds static certificate pairs and picks one by the names it is
+// valid for.
+type Store struct {
+	pairs []Pair
+
+	mu     sync.RWMutex
+	byName map[string]*tls.Certificate
+	first  *tls.Certificate
+
+	watcher *fsnotify.Watcher
+}
+
+// NewStore loads pairs. The first pair is also used for clients that send
+// no server name.
+func NewStore(pairs []Pair) (*Store, error) {
+	s := &Store{pairs: pairs}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	byName := make(map[string]*tls.Certificate)
+	var first *tls.Certificate
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return fmt.Errorf("load %s: %s", pair.Cert, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parse %s: %s", pair.Cert, err)
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		if first == nil {
+			first = &cert
+		}
+	}
+	s.mu.Lock()
+	s.byName, s.first = byName, first
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the certificate for name, trying a wildcard certificate
+// after an exact one, or nil.
+func (s *Store) Lookup(name string) *tls.Certificate {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name == "" {
+		return s.first
+	}
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return s.byName["*"+name[i:]]
+	}
+	return nil
+}
+
+// Default returns the certificate of the first pair, or nil.
+func (s *Store) Default() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.first
+}
+
+// GetCertificate suits tls.Config.GetCertificate. Names no pair is valid
+// for get the Default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if cert := s.Default(); cert != nil {
+		return cert, nil
+	}
+	return nil, ErrNoCertificate
+}
+
+// Watch reloads every pair when one of the files is written or replaced,
+// until Close. A reload that fails keeps the certificates in use.
+func (s *Store) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	for _, pair := range s.pairs {
+		for _, f := range []string{pair.Cert, pair.Key} {
+			path, _ := filepath.Abs(f)
+			files[path] = true
+			// Watch the directory, certificate renewal tools usually
+			// replace the files or the symlinks pointing to them.
+			if err := watcher.Add(filepath.Dir(path)); err != nil {
+				watcher.Close()
+				return err
+			}
+		}
+	}
+	s.watcher = watcher
+	go s.watch(files)
+	return nil
+}
+
+func (s *Store) watch(files map[string]bool) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			// Kubernetes swaps a "..data" symlink to update mounted files.
+			if files[filepath.Clean(event.Name)] || strings.HasPrefix(filepath.Base(event.Name), "..") {
+				debounce = time.After(500 * time.Millisecond)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warningf("Watch certificate files error. %s", err.Error())
+		case <-debounce:
+			debounce = nil
+			if err := s.load(); err != nil {
+				log.Warningf("Reload certificates failed, keep the loaded ones. %s", err.Error())
+			} else {
+				log.Warningf("Reloaded %d certificates.", len(s.pairs))
+			}
+		}
+	}
+}
+
+// Close stops watching the files.
+func (s *Store) Close() {
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+}
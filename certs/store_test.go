@@ -0,0 +1,155 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names, or with only
+// commonName if names is empty, and its key to dir.
+func writePair(t *testing.T, dir, file, commonName string, names ...string) Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := Pair{Cert: filepath.Join(dir, file+".crt"), Key: filepath.Join(dir, file+".key")}
+	// The key goes first, so a watcher never sees a certificate without it.
+	if err := ioutil.WriteFile(pair.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// names returns the names cert is valid for.
+func names(cert *tls.Certificate) []string {
+	if cert == nil {
+		return nil
+	}
+	if len(cert.Leaf.DNSNames) == 0 {
+		return []string{cert.Leaf.Subject.CommonName}
+	}
+	return cert.Leaf.DNSNames
+}
+
+func TestStoreLookup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore([]Pair{
+		writePair(t, dir, "first", "first", "a.example.com", "b.example.com"),
+		writePair(t, dir, "wildcard", "wildcard", "*.example.net", "b.example.com"),
+		writePair(t, dir, "cn", "cn.example.org"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// want is the first name of the certificate expected, "" for none.
+		want string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.COM.", "a.example.com"},
+		// The first pair valid for a name wins.
+		{"b.example.com", "a.example.com"},
+		{"www.example.net", "*.example.net"},
+		{"example.net", ""},
+		{"a.www.example.net", ""},
+		{"cn.example.org", "cn.example.org"},
+		{"other.example.com", ""},
+		// Clients without SNI get the first pair.
+		{"", "a.example.com"},
+	}
+	for _, test := range tests {
+		got := ""
+		if cert := store.Lookup(test.name); cert != nil {
+			got = names(cert)[0]
+		}
+		if got != test.want {
+			t.Errorf("Lookup(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	if err != nil || names(cert)[0] != "a.example.com" {
+		t.Errorf("GetCertificate of an unknown name = %q, %v, want the first pair", names(cert), err)
+	}
+	empty, err := NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); err != ErrNoCertificate {
+		t.Errorf("GetCertificate of an empty store: %v, want %v", err, ErrNoCertificate)
+	}
+	if _, err := NewStore([]Pair{{Cert: filepath.Join(dir, "missing.crt"), Key: filepath.Join(dir, "missing.key")}}); err == nil {
+		t.Error("NewStore loaded missing files")
+	}
+}
+
+// waitFor polls until the certificate for name is valid for want.
+func waitFor(t *testing.T, store *Store, name, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := names(store.Lookup(name))
+		if len(got) > 0 && got[0] == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate for %q is for %q, want %q", name, got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore([]Pair{writePair(t, dir, "site", "site", "old.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// A renewal replaces the files.
+	writePair(t, dir, "site", "site", "new.example.com")
+	waitFor(t, store, "", "new.example.com")
+	if cert := store.Lookup("old.example.com"); cert != nil {
+		t.Errorf("old.example.com still has certificate %q", names(cert))
+	}
+
+	// A broken file keeps the certificate in use.
+	if err := ioutil.WriteFile(filepath.Join(dir, "site.crt"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	waitFor(t, store, "new.example.com", "new.example.com")
+}
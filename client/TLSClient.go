@@ -1,159 +1,207 @@
 package TLSClient
 
 import (
-	"github.com/op/go-logging"
-	"os"
-	"net"
-	"sync"
-	"io"
 	"crypto/tls"
+	"github.com/Catofes/SniGateway/tunnel"
+	"net"
+	"strconv"
 	"strings"
-	"regexp"
+	"time"
 )
 
-var log *logging.Logger
-var Log *logging.Logger
-
-func init() {
-	log = logging.MustGetLogger("example")
-	backend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{color}%{time:0102 15:04:05.000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(backend, format)
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
-	backendLeveled.SetLevel(logging.WARNING, "")
-	logging.SetBackend(backendLeveled)
-	Log = log
-}
+var Log = tunnel.Log
 
+// TLSClient tunnels connections to a TLSServer over TLS.
 type TLSClient struct {
-	ListenAddress  string
+	tunnel.Client
 	BackendAddress string
-	Domain         string
-	VPNMode        bool
+	// Domain is the name the server certificate must be valid for and sni
+	// the name sent in the ClientHello. Each defaults to the other, and
+	// both to the host of BackendAddress.
+	Domain string
+	sni    string
+	// caPath replaces the system roots, pins are public keys one of which
+	// the server chain must have, and insecure skips verifying the chain
+	// and name, for testing only. Pins are still checked when insecure.
+	caPath   string
+	pins     string
+	insecure bool
+	// certPath and keyPath are the client certificate presented to a
+	// TLSServer that requires one.
+	certPath string
+	keyPath  string
+	// token and alpn are the other ways a TLSServer may authenticate
+	// clients by.
+	token string
+	alpn  string
+	// mux, if not zero, is how many connections to carry every tunnel
+	// over as streams, pinging the server every keepAlive.
+	mux       int
+	keepAlive time.Duration
+	// pool is how many connections to keep dialed ahead when not in mux
+	// mode, each for at most poolIdle.
+	pool     int
+	poolIdle time.Duration
+	// fingerprint names the browser ClientHello to imitate, Go's own if
+	// empty.
+	fingerprint string
+	// ech is the ECHConfigList of the server, or a file holding it, to
+	// encrypt the ClientHello with.
+	ech string
 }
 
 func (s *TLSClient) Init() *TLSClient {
-	SS_LOCAL_HOST := os.Getenv("SS_LOCAL_HOST")
-	SS_REMOTE_HOST := os.Getenv("SS_REMOTE_HOST")
-	SS_LOCAL_PORT := os.Getenv("SS_LOCAL_PORT")
-	SS_REMOTE_PORT := os.Getenv("SS_REMOTE_PORT")
-	SS_PLUGIN_OPTIONS := os.Getenv("SS_PLUGIN_OPTIONS")
-	s.BackendAddress = SS_REMOTE_HOST + ":" + SS_REMOTE_PORT
-	s.ListenAddress = SS_LOCAL_HOST + ":" + SS_LOCAL_PORT
-	ip_reg := `(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)`
-	if ok, _ := regexp.MatchString(ip_reg, SS_REMOTE_PORT); !ok {
-		s.Domain = SS_REMOTE_HOST
-	}
-	s.VPNMode = true
-	s.LoadOption(SS_PLUGIN_OPTIONS)
-	//s.BackendAddress = SS_REMOTE_HOST + ":" + SS_REMOTE_PORT
-	return s
-}
-
-func String2Bool(input string) bool {
-	switch input {
-	case "false":
-		return false
-	case "0":
-		return false
-	case "False":
-		return false
-	default:
-		return true
+	s.Client.Init()
+	if tunnel.Launched() {
+		plugin := tunnel.LoadPlugin()
+		s.ListenAddress = plugin.LocalAddress()
+		s.BackendAddress = plugin.RemoteAddress()
+		s.LoadOption(tunnel.ParseOptions(plugin.Options, optionAliases))
+	} else {
+		standalone, err := tunnel.LoadStandalone(optionAliases)
+		if err != nil {
+			Log.Fatalf("Load config failed. %s", err.Error())
+		}
+		s.ListenAddress = standalone.Listen
+		s.BackendAddress = standalone.Backend
+		s.VPNMode = false
+		s.LoadOption(standalone.Options)
 	}
-}
-
-func (s *TLSClient) LoadOption(option string) {
-	data := strings.Split(option, ";")
-	for _, v := range data {
-		d := strings.Split(v, "=")
-		if len(d) != 2 {
-			continue
+	if s.Domain == "" {
+		s.Domain = s.sni
+	}
+	if s.Domain == "" {
+		s.Domain = tunnel.ServerName(s.BackendAddress)
+	}
+	if s.sni == "" {
+		s.sni = s.Domain
+	}
+	check := &tunnel.ServerCheck{Name: s.Domain, Insecure: s.insecure}
+	if check.Name == "" {
+		check.Name, _, _ = net.SplitHostPort(s.BackendAddress)
+	}
+	if s.caPath != "" {
+		roots, err := tunnel.LoadCertPool(s.caPath)
+		if err != nil {
+			Log.Fatalf("Load CA failed. %s", err.Error())
 		}
-		key := d[0]
-		value := d[1]
-		switch key {
-		case "domain":
-			s.Domain = value
-		case "Mode":
-			s.VPNMode = String2Bool(value)
+		check.Roots = roots
+	}
+	if s.pins != "" {
+		pins, err := tunnel.ParsePins(s.pins)
+		if err != nil {
+			Log.Fatalf("Load pins failed. %s", err.Error())
 		}
+		check.Pins = pins
 	}
-}
-
-func (s *TLSClient) Listen() {
-	ln, err := net.Listen("tcp", s.ListenAddress)
-	if err != nil {
-		log.Fatalf("Error Listen Port. %s", err.Error())
-	}
-	defer ln.Close()
-	wg := &sync.WaitGroup{}
-	for {
-		conn, err := ln.Accept()
-		log.Debug("Accept connection.")
+	if s.insecure {
+		Log.Warningf("Server certificates are not verified, which is only safe for testing.")
+	}
+	config := &tls.Config{
+		ServerName: s.sni,
+		// Shared by every connection, so that they resume the session of an
+		// earlier one instead of doing a full handshake.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if s.certPath != "" {
+		cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
 		if err != nil {
-			log.Warningf("Can not accept conn. %s", err.Error())
-			continue
+			Log.Fatalf("Load client cert failed. %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if s.alpn != "" {
+		config.NextProtos = []string{s.alpn}
+	}
+	check.Apply(config)
+	if s.ech != "" {
+		if s.fingerprint != "" {
+			Log.Fatalf("Invalid option. ech and fingerprint cannot be combined.")
 		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			s.handleConn(conn)
-		}()
+		list, err := tunnel.LoadECHConfigList(s.ech)
+		if err != nil {
+			Log.Fatalf("Load ECH config failed. %s", err.Error())
+		}
+		config.EncryptedClientHelloConfigList = list
+		config.MinVersion = tls.VersionTLS13
+	}
+	if s.fingerprint != "" {
+		if err := tunnel.CheckFingerprint(s.fingerprint); err != nil {
+			Log.Fatalf("Invalid option. %s", err.Error())
+		}
+	}
+	dialer := &tunnel.TLSDialer{
+		Address:     s.BackendAddress,
+		Config:      config,
+		Fingerprint: s.fingerprint,
 	}
-	wg.Wait()
+	if s.token != "" {
+		dialer.Preamble = tunnel.TokenHeader(s.token)
+	}
+	s.Dialer = dialer
+	if s.mux > 0 && s.pool > 0 {
+		Log.Warningf("Ignore pool in mux mode, whose connections stay open anyway.")
+	}
+	if s.mux > 0 {
+		s.Dialer = &tunnel.MuxDialer{Dialer: dialer, Sessions: s.mux, KeepAlive: s.keepAlive}
+	} else if s.pool > 0 {
+		s.Dialer = &tunnel.PoolDialer{Dialer: dialer, Idle: s.pool, MaxIdle: s.poolIdle}
+	}
+	return s
 }
 
-func (s *TLSClient) handleConn(conn net.Conn) {
-	defer conn.Close()
-	upConn := conn
-	log.Debugf("accepted: %s", conn.RemoteAddr())
-	tcpConn, err := net.Dial("tcp", s.BackendAddress)
-	if err != nil {
-		log.Warningf("TCP connect to %s failed: %s", s.BackendAddress, err)
-		return
-	}
-	defer tcpConn.Close()
-	downConn := tls.Client(tcpConn, &tls.Config{ServerName: s.Domain})
-	err = downConn.Handshake()
-	if err != nil {
-		log.Warningf("TLS handshake to %s(%s) failed: %s", s.BackendAddress, s.Domain, err)
-		return
-	}
-	if err := s.Pipe(upConn, downConn, tcpConn); err != nil {
-		log.Warningf("pipe failed: %s", err)
-	} else {
-		log.Debugf("disconnected: %s", upConn.RemoteAddr())
-	}
+// optionAliases maps the option names other SIP003 plugins use onto ours.
+var optionAliases = map[string]string{
+	"host": "domain",
 }
 
-func (s *TLSClient) Pipe(a, b, c net.Conn) error {
-	done := make(chan error, 1)
-	download := func(a, b, c net.Conn) {
-		n, err := io.Copy(a, b)
-		log.Debugf("copied %d bytes from %s to %s", n, b.RemoteAddr(), a.RemoteAddr())
-		c.(*net.TCPConn).CloseRead()
-		a.(*net.TCPConn).CloseWrite()
-		done <- err
-	}
-	upload := func(a, b, c net.Conn) {
-		n, err := io.Copy(b, a)
-		log.Debugf("copied %d bytes from %s to %s", n, a.RemoteAddr(), b.RemoteAddr())
-		a.(*net.TCPConn).CloseRead()
-		c.(*net.TCPConn).CloseWrite()
-		done <- err
-	}
-	go download(a, b, c)
-	go upload(a, b, c)
-	err1 := <-done
-	err2 := <-done
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
-	}
-	return nil
+func (s *TLSClient) LoadOption(options tunnel.Options) {
+	for key, value := range options {
+		switch key {
+		case "domain":
+			s.Domain = value
+		case "sni":
+			s.sni = value
+		case "ca":
+			s.caPath = value
+		case "pin":
+			s.pins = value
+		case "ech":
+			s.ech = value
+		case "fingerprint":
+			s.fingerprint = strings.ToLower(value)
+		case "insecure":
+			s.insecure = value == "" || tunnel.String2Bool(value)
+		case "cert":
+			s.certPath = value
+		case "key":
+			s.keyPath = value
+		case "token":
+			s.token = value
+		case "alpn":
+			s.alpn = value
+		case "mux":
+			if value == "" {
+				s.mux = tunnel.DefaultMuxSessions
+			} else if n, err := strconv.Atoi(value); err == nil {
+				s.mux = n
+			} else if tunnel.String2Bool(value) {
+				s.mux = tunnel.DefaultMuxSessions
+			}
+		case "pool":
+			if n, err := strconv.Atoi(value); err == nil {
+				s.pool = n
+			}
+		case "pool-idle":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				s.poolIdle = time.Duration(seconds) * time.Second
+			}
+		case "keepalive":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				s.keepAlive = time.Duration(seconds) * time.Second
+			}
+		default:
+			s.SetOption(key, value)
+		}
+	}
 }
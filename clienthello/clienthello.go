@@ -0,0 +1,272 @@
+// Package clienthello parses the TLS ClientHello a client sends as the first
+// flight of a connection. It never panics on malformed input: every length
+// is bounds checked and failures are reported with one of the Err values.
+package clienthello
+
+import (
+	"errors"
+)
+
+const (
+	recordTypeHandshake   uint8 = 0x16
+	handshakeClientHello  uint8 = 0x01
+	recordHeaderLength          = 5
+	handshakeHeaderLength       = 4
+	maxRecordLength             = 1<<14 + 2048
+
+	extensionServerName        uint16 = 0
+	extensionALPN              uint16 = 16
+	extensionSupportedVersions uint16 = 43
+
+	serverNameTypeHostName uint8 = 0
+)
+
+var (
+	ErrNotHandshake   = errors.New("clienthello: not a TLS handshake record")
+	ErrRecordVersion  = errors.New("clienthello: unsupported record version")
+	ErrNotClientHello = errors.New("clienthello: handshake is not a ClientHello")
+	ErrTruncated      = errors.New("clienthello: message truncated")
+	ErrMalformed      = errors.New("clienthello: malformed message")
+	ErrTooLarge       = errors.New("clienthello: message exceeds size limit")
+)
+
+// ClientHello holds the fields of a parsed ClientHello message.
+type ClientHello struct {
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+	// Extensions lists the extension types in the order the client sent them.
+	Extensions        []uint16
+	ServerName        string
+	ALPNProtocols     []string
+	SupportedVersions []uint16
+}
+
+// Parse parses a ClientHello straight off the wire, starting with the TLS
+// record header. The handshake message may be fragmented over several
+// records; ErrTruncated is returned if data ends before it is complete.
+func Parse(data []byte) (*ClientHello, error) {
+	msg, _, err := handshakeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHandshake(msg)
+}
+
+// handshakeMessage reassembles the first handshake message carried by the
+// records in data. It returns the message including its 4-byte header and
+// the number of bytes of data the records holding it occupy.
+func handshakeMessage(data []byte) ([]byte, int, error) {
+	var msg []byte
+	consumed := 0
+	for {
+		if len(msg) >= handshakeHeaderLength {
+			length, err := handshakeLength(msg)
+			if err != nil {
+				return nil, consumed, err
+			}
+			if len(msg) >= length {
+				return msg[:length], consumed, nil
+			}
+		}
+		fragment, n, err := record(data[consumed:])
+		if err != nil {
+			return nil, consumed, err
+		}
+		consumed += n
+		msg = append(msg, fragment...)
+	}
+}
+
+// handshakeLength returns the length of the ClientHello message starting at
+// msg, including its header.
+func handshakeLength(msg []byte) (int, error) {
+	if msg[0] != handshakeClientHello {
+		return 0, ErrNotClientHello
+	}
+	return handshakeHeaderLength + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])), nil
+}
+
+// record returns the payload of the handshake record at the start of data
+// and the total length of that record.
+func record(data []byte) ([]byte, int, error) {
+	if len(data) < recordHeaderLength {
+		return nil, 0, ErrTruncated
+	}
+	length, err := recordLength(data[:recordHeaderLength])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < recordHeaderLength+length {
+		return nil, 0, ErrTruncated
+	}
+	return data[recordHeaderLength : recordHeaderLength+length], recordHeaderLength + length, nil
+}
+
+// recordLength validates a record header and returns its payload length.
+func recordLength(header []byte) (int, error) {
+	if header[0] != recordTypeHandshake {
+		return 0, ErrNotHandshake
+	}
+	if header[1] != 3 {
+		return 0, ErrRecordVersion
+	}
+	length := int(header[3])<<8 | int(header[4])
+	if length == 0 || length > maxRecordLength {
+		return 0, ErrMalformed
+	}
+	return length, nil
+}
+
+// ParseHandshake parses a ClientHello handshake message, starting with the
+// 4-byte handshake header.
+func ParseHandshake(msg []byte) (*ClientHello, error) {
+	s := input(msg)
+	var msgType uint8
+	var body input
+	if !s.readUint8(&msgType) {
+		return nil, ErrTruncated
+	}
+	if msgType != handshakeClientHello {
+		return nil, ErrNotClientHello
+	}
+	if !s.readUint24Prefixed(&body) {
+		return nil, ErrTruncated
+	}
+	if !s.empty() {
+		return nil, ErrMalformed
+	}
+
+	hello := &ClientHello{}
+	var sessionID, cipherSuites, compressionMethods input
+	if !body.readUint16(&hello.Version) ||
+		!body.readBytes(&hello.Random, 32) ||
+		!body.readUint8Prefixed(&sessionID) ||
+		!body.readUint16Prefixed(&cipherSuites) ||
+		!body.readUint8Prefixed(&compressionMethods) {
+		return nil, ErrTruncated
+	}
+	if len(sessionID) > 32 {
+		return nil, ErrMalformed
+	}
+	hello.SessionID = sessionID
+	if len(cipherSuites) == 0 || len(cipherSuites)%2 != 0 {
+		return nil, ErrMalformed
+	}
+	for !cipherSuites.empty() {
+		var suite uint16
+		cipherSuites.readUint16(&suite)
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+	if len(compressionMethods) == 0 {
+		return nil, ErrMalformed
+	}
+	hello.CompressionMethods = compressionMethods
+
+	if body.empty() {
+		// ClientHello is optionally followed by extension data
+		return hello, nil
+	}
+	var extensions input
+	if !body.readUint16Prefixed(&extensions) {
+		return nil, ErrTruncated
+	}
+	if !body.empty() {
+		return nil, ErrMalformed
+	}
+
+	seen := make(map[uint16]bool)
+	for !extensions.empty() {
+		var extension uint16
+		var data input
+		if !extensions.readUint16(&extension) || !extensions.readUint16Prefixed(&data) {
+			return nil, ErrTruncated
+		}
+		if seen[extension] {
+			return nil, ErrMalformed
+		}
+		seen[extension] = true
+		hello.Extensions = append(hello.Extensions, extension)
+
+		var err error
+		switch extension {
+		case extensionServerName:
+			hello.ServerName, err = parseServerName(data)
+		case extensionALPN:
+			hello.ALPNProtocols, err = parseALPN(data)
+		case extensionSupportedVersions:
+			hello.SupportedVersions, err = parseSupportedVersions(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hello, nil
+}
+
+func parseServerName(data input) (string, error) {
+	var list input
+	if !data.readUint16Prefixed(&list) {
+		return "", ErrTruncated
+	}
+	if !data.empty() || list.empty() {
+		return "", ErrMalformed
+	}
+	serverName := ""
+	for !list.empty() {
+		var nameType uint8
+		var name input
+		if !list.readUint8(&nameType) || !list.readUint16Prefixed(&name) {
+			return "", ErrTruncated
+		}
+		if nameType != serverNameTypeHostName {
+			continue
+		}
+		if serverName != "" || len(name) == 0 {
+			return "", ErrMalformed
+		}
+		serverName = string(name)
+	}
+	return serverName, nil
+}
+
+func parseALPN(data input) ([]string, error) {
+	var list input
+	if !data.readUint16Prefixed(&list) {
+		return nil, ErrTruncated
+	}
+	if !data.empty() || list.empty() {
+		return nil, ErrMalformed
+	}
+	var protocols []string
+	for !list.empty() {
+		var protocol input
+		if !list.readUint8Prefixed(&protocol) {
+			return nil, ErrTruncated
+		}
+		if len(protocol) == 0 {
+			return nil, ErrMalformed
+		}
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols, nil
+}
+
+func parseSupportedVersions(data input) ([]uint16, error) {
+	var list input
+	if !data.readUint8Prefixed(&list) {
+		return nil, ErrTruncated
+	}
+	if !data.empty() || len(list) == 0 || len(list)%2 != 0 {
+		return nil, ErrMalformed
+	}
+	var versions []uint16
+	for !list.empty() {
+		var version uint16
+		list.readUint16(&version)
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
@@ -0,0 +1,182 @@
+package clienthello
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func readCorpus(t testing.TB, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("corpus", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseCorpus(t *testing.T) {
+	tests := []struct {
+		file              string
+		serverName        string
+		alpn              []string
+		supportedVersions []uint16
+		records           int
+	}{
+		{"sni", "example.com", nil, []uint16{0x0304, 0x0303}, 1},
+		{"sni-alpn", "www.example.org", []string{"h2", "http/1.1"}, []uint16{0x0304, 0x0303}, 1},
+		{"no-sni", "", nil, []uint16{0x0304, 0x0303}, 1},
+		{"fragmented", "example.com", nil, []uint16{0x0304, 0x0303}, 2},
+		{"tls12", "a.b.com", nil, []uint16{0x0303}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			data := readCorpus(t, test.file)
+			hello, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.Version != 0x0303 {
+				t.Errorf("Version = %#04x, want 0x0303", hello.Version)
+			}
+			if hello.ServerName != test.serverName {
+				t.Errorf("ServerName = %q, want %q", hello.ServerName, test.serverName)
+			}
+			if !reflect.DeepEqual(hello.ALPNProtocols, test.alpn) {
+				t.Errorf("ALPNProtocols = %q, want %q", hello.ALPNProtocols, test.alpn)
+			}
+			if !reflect.DeepEqual(hello.SupportedVersions, test.supportedVersions) {
+				t.Errorf("SupportedVersions = %#04x, want %#04x", hello.SupportedVersions, test.supportedVersions)
+			}
+			if _, n, err := handshakeMessage(data); err != nil || n != len(data) {
+				t.Errorf("records take %d of %d bytes: %v", n, len(data), err)
+			}
+			records := 0
+			for rest := data; len(rest) > 0; records++ {
+				_, n, err := record(rest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if records != test.records {
+				t.Errorf("%d records, want %d", records, test.records)
+			}
+
+			// Read must see the same message however the stream is split,
+			// and hand back exactly the bytes it consumed.
+			for name, r := range map[string]io.Reader{
+				"whole":     bytes.NewReader(data),
+				"byte-wise": iotest.OneByteReader(bytes.NewReader(data)),
+				"with more": io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte{0x17, 3, 3})),
+			} {
+				got, raw, err := Read(r, len(data))
+				if err != nil {
+					t.Fatalf("Read %s: %s", name, err)
+				}
+				if !reflect.DeepEqual(got, hello) {
+					t.Errorf("Read %s = %+v, want %+v", name, got, hello)
+				}
+				if !bytes.Equal(raw, data) {
+					t.Errorf("Read %s returned %d raw bytes, want %d", name, len(raw), len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	for _, file := range []string{"sni", "sni-alpn", "no-sni", "fragmented", "tls12"} {
+		data := readCorpus(t, file)
+		for n := 0; n < len(data); n++ {
+			if hello, err := Parse(data[:n]); err != ErrTruncated || hello != nil {
+				t.Fatalf("%s cut at %d: got %v, %v, want ErrTruncated", file, n, hello, err)
+			}
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+		err    error
+	}{
+		{"application data", func(d []byte) []byte { d[0] = 0x17; return d }, ErrNotHandshake},
+		{"SSLv2 record", func(d []byte) []byte { d[1] = 2; return d }, ErrRecordVersion},
+		{"empty record", func(d []byte) []byte { d[3], d[4] = 0, 0; return d }, ErrMalformed},
+		{"oversized record", func(d []byte) []byte { d[3], d[4] = 0xff, 0xff; return d }, ErrMalformed},
+		{"server hello", func(d []byte) []byte { d[5] = 2; return d }, ErrNotClientHello},
+		{"session id too long", func(d []byte) []byte {
+			// Pad the 32-byte session ID to 33 bytes.
+			d = append(d[:44+32], append([]byte{0}, d[44+32:]...)...)
+			d[43]++
+			d[4]++
+			d[8]++
+			return d
+		}, ErrMalformed},
+		{"trailing handshake data", func(d []byte) []byte {
+			// Grow the record and handshake by one byte past the extensions.
+			d = append(d, 0)
+			d[4]++
+			d[8]++
+			return d
+		}, ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.modify(readCorpus(t, "tls12"))
+			if hello, err := Parse(data); err != test.err || hello != nil {
+				t.Errorf("got %v, %v, want %v", hello, err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadTooLarge(t *testing.T) {
+	data := readCorpus(t, "sni")
+	_, raw, err := Read(bytes.NewReader(data), 512)
+	if err != ErrTooLarge {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	if !bytes.Equal(raw, data[:len(raw)]) {
+		t.Error("raw bytes differ from the stream")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("corpus", "*"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, err := Parse(data)
+		if err != nil {
+			if hello != nil {
+				t.Fatalf("hello %+v along with error %v", hello, err)
+			}
+			return
+		}
+		// Read parses records the same way as Parse.
+		got, raw, err := Read(bytes.NewReader(data), len(data))
+		if err != nil {
+			t.Fatalf("Parse succeeded but Read failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, hello) {
+			t.Fatalf("Read = %+v, Parse = %+v", got, hello)
+		}
+		if !bytes.HasPrefix(data, raw) {
+			t.Fatal("raw bytes differ from the input")
+		}
+	})
+}
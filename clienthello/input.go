@@ -0,0 +1,74 @@
+package clienthello
+
+// input is a cursor over a byte slice. Every read checks the remaining
+// length first and reports false instead of slicing out of range.
+type input []byte
+
+func (s *input) empty() bool {
+	return len(*s) == 0
+}
+
+func (s *input) take(n int) ([]byte, bool) {
+	if n < 0 || len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *input) readUint8(out *uint8) bool {
+	v, ok := s.take(1)
+	if !ok {
+		return false
+	}
+	*out = v[0]
+	return true
+}
+
+func (s *input) readUint16(out *uint16) bool {
+	v, ok := s.take(2)
+	if !ok {
+		return false
+	}
+	*out = uint16(v[0])<<8 | uint16(v[1])
+	return true
+}
+
+func (s *input) readBytes(out *[]byte, n int) bool {
+	v, ok := s.take(n)
+	if !ok {
+		return false
+	}
+	*out = v
+	return true
+}
+
+func (s *input) readPrefixed(out *input, lengthBytes int) bool {
+	prefix, ok := s.take(lengthBytes)
+	if !ok {
+		return false
+	}
+	n := 0
+	for _, b := range prefix {
+		n = n<<8 | int(b)
+	}
+	v, ok := s.take(n)
+	if !ok {
+		return false
+	}
+	*out = v
+	return true
+}
+
+func (s *input) readUint8Prefixed(out *input) bool {
+	return s.readPrefixed(out, 1)
+}
+
+func (s *input) readUint16Prefixed(out *input) bool {
+	return s.readPrefixed(out, 2)
+}
+
+func (s *input) readUint24Prefixed(out *input) bool {
+	return s.readPrefixed(out, 3)
+}
@@ -0,0 +1,52 @@
+package clienthello
+
+import (
+	"io"
+)
+
+// Read reads TLS records from r until they hold a complete ClientHello,
+// however the client split it over TCP segments or handshake records. It
+// returns the parsed message together with every byte consumed from r, so
+// the caller can replay the exact stream to a backend. The raw bytes are
+// returned on error as well. ErrTooLarge is returned once more than maxSize
+// bytes would have to be read.
+func Read(r io.Reader, maxSize int) (*ClientHello, []byte, error) {
+	var raw, msg []byte
+	for {
+		if len(msg) >= handshakeHeaderLength {
+			length, err := handshakeLength(msg)
+			if err != nil {
+				return nil, raw, err
+			}
+			if length > maxSize {
+				return nil, raw, ErrTooLarge
+			}
+			if len(msg) >= length {
+				hello, err := ParseHandshake(msg[:length])
+				return hello, raw, err
+			}
+		}
+
+		start := len(raw)
+		if start+recordHeaderLength > maxSize {
+			return nil, raw, ErrTooLarge
+		}
+		raw = append(raw, make([]byte, recordHeaderLength)...)
+		if n, err := io.ReadFull(r, raw[start:]); err != nil {
+			return nil, raw[:start+n], err
+		}
+		length, err := recordLength(raw[start:])
+		if err != nil {
+			return nil, raw, err
+		}
+		if len(raw)+length > maxSize {
+			return nil, raw, ErrTooLarge
+		}
+		payload := len(raw)
+		raw = append(raw, make([]byte, length)...)
+		if n, err := io.ReadFull(r, raw[payload:]); err != nil {
+			return nil, raw[:payload+n], err
+		}
+		msg = append(msg, raw[payload:]...)
+	}
+}
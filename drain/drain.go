@@ -0,0 +1,126 @@
+// Package drain lets a server stop gracefully: it tracks the connections
+// being handled, waits for them to finish after the listeners are closed,
+// and force-closes whatever is still open once the drain timeout passes.
+package drain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type entry struct {
+	since   time.Time
+	primary bool
+}
+
+// Tracker tracks accepted connections and the goroutines handling them.
+type Tracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]entry
+}
+
+// Go runs handle(conn) in a new goroutine and tracks conn until it returns.
+func (t *Tracker) Go(conn net.Conn, handle func(net.Conn)) {
+	t.add(conn, true)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.remove(conn)
+		handle(conn)
+	}()
+}
+
+// Track adds a secondary connection, such as the backend side of a pipe,
+// so it is force-closed with the rest. Call the returned func once it is
+// closed.
+func (t *Tracker) Track(conn net.Conn) func() {
+	t.add(conn, false)
+	return func() { t.remove(conn) }
+}
+
+func (t *Tracker) add(conn net.Conn, primary bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]entry)
+	}
+	t.conns[conn] = entry{time.Now(), primary}
+}
+
+func (t *Tracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+}
+
+// Active returns the number of connections being handled.
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, e := range t.conns {
+		if e.primary {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary reports how a drain went.
+type Summary struct {
+	// Drained connections finished on their own, Forced ones were closed
+	// when the timeout passed.
+	Drained int
+	Forced  []string
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d connections drained, %d force-closed", s.Drained, len(s.Forced))
+}
+
+// Drain waits up to timeout for every handler started by Go to return, then
+// closes the connections still open and waits for their handlers to exit.
+// The listeners must already be closed.
+func (t *Tracker) Drain(timeout time.Duration) Summary {
+	active := t.Active()
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return Summary{Drained: active}
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	var forced []string
+	now := time.Now()
+	for conn, e := range t.conns {
+		if e.primary {
+			forced = append(forced, fmt.Sprintf("%s (open %s)", conn.RemoteAddr(), now.Sub(e.since).Truncate(time.Second)))
+		}
+		conn.Close()
+	}
+	t.mu.Unlock()
+	<-done
+	sort.Strings(forced)
+	return Summary{Drained: active - len(forced), Forced: forced}
+}
+
+// WaitSignal blocks until the process receives SIGINT or SIGTERM.
+func WaitSignal() os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	signal.Stop(c)
+	return sig
+}
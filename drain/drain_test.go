@@ -0,0 +1,85 @@
+package drain
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainFinished(t *testing.T) {
+	var tr Tracker
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		a, b := net.Pipe()
+		defer b.Close()
+		tr.Go(a, func(conn net.Conn) {
+			<-release
+			conn.Close()
+		})
+	}
+	if n := tr.Active(); n != 2 {
+		t.Fatalf("%d active, want 2", n)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	summary := tr.Drain(5 * time.Second)
+	if summary.Drained != 2 || len(summary.Forced) != 0 {
+		t.Errorf("summary %v, want 2 drained", summary)
+	}
+	if n := tr.Active(); n != 0 {
+		t.Errorf("%d active after the drain", n)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var tr Tracker
+	// One handler finishes in time, the other keeps reading until its
+	// connection is closed.
+	quick, quickPeer := net.Pipe()
+	defer quickPeer.Close()
+	tr.Go(quick, func(conn net.Conn) {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	})
+
+	stuck, stuckPeer := net.Pipe()
+	defer stuckPeer.Close()
+	backend, backendPeer := net.Pipe()
+	defer backendPeer.Close()
+	backendClosed := make(chan struct{})
+	tr.Go(stuck, func(conn net.Conn) {
+		defer tr.Track(backend)()
+		conn.Read(make([]byte, 1))
+		// The backend is closed with it, not by the handler.
+		if _, err := backend.Write([]byte{1}); err != nil {
+			close(backendClosed)
+		}
+	})
+
+	start := time.Now()
+	summary := tr.Drain(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("drain returned after %s, before the timeout", elapsed)
+	}
+	if summary.Drained != 1 || len(summary.Forced) != 1 {
+		t.Errorf("summary %v, want 1 drained and 1 forced", summary)
+	}
+	select {
+	case <-backendClosed:
+	default:
+		t.Error("tracked backend connection not closed")
+	}
+	if n := tr.Active(); n != 0 {
+		t.Errorf("%d active after the drain", n)
+	}
+}
+
+func TestDrainIdle(t *testing.T) {
+	var tr Tracker
+	start := time.Now()
+	if summary := tr.Drain(time.Second); summary.Drained != 0 || len(summary.Forced) != 0 {
+		t.Errorf("summary %v of an idle tracker", summary)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("idle drain took %s", elapsed)
+	}
+}
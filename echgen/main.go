@@ -0,0 +1,56 @@
+// echgen creates an ECH key for the ech-key option of TLSServer and prints
+// the ECHConfigList for the ech option of TLSClient.
+//
+//	echgen -public-name cover.example.com -out ech.pem
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Catofes/SniGateway/tunnel"
+)
+
+func main() {
+	publicName := flag.String("public-name", "", "Name shown in the unencrypted outer ClientHello.")
+	out := flag.String("out", "ech.pem", "File to write the key and config to.")
+	flag.Parse()
+	if *publicName == "" {
+		fatal(fmt.Errorf("-public-name is required"))
+	}
+
+	// Clients echo the config id, so a random one tells rotated keys apart.
+	id := make([]byte, 1)
+	if _, err := rand.Read(id); err != nil {
+		fatal(err)
+	}
+	data, err := tunnel.GenerateECH(*publicName, id[0])
+	if err != nil {
+		fatal(err)
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(err)
+	}
+	list, err := tunnel.LoadECHConfigList(*out)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "Created", *out)
+	fmt.Println(base64.StdEncoding.EncodeToString(list))
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const reasonAccessDenied = "access_denied"
+
+// Access decides which client addresses may connect. A client matching a
+// Deny entry is refused. Otherwise, if any Allow entry is set, the client
+// must match one of them. Addresses are single IPs or CIDRs, given inline or
+// in files with one per line and "#" comments. Countries are ISO codes such
+// as "DE", looked up in Config.GeoIPDatabase. Files are read again when the
+// config is reloaded.
+type Access struct {
+	Allow          []string
+	AllowFiles     []string
+	AllowCountries []string
+	Deny           []string
+	DenyFiles      []string
+	DenyCountries  []string
+}
+
+// acl is Access ready to check addresses with.
+type acl struct {
+	allow, deny    []*net.IPNet
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	restricted     bool
+	geo            *maxminddb.Reader
+}
+
+func (a *Access) compile(geo *maxminddb.Reader) (*acl, error) {
+	l := &acl{geo: geo}
+	var err error
+	if l.allow, err = parseNets(a.Allow, a.AllowFiles); err != nil {
+		return nil, err
+	}
+	if l.deny, err = parseNets(a.Deny, a.DenyFiles); err != nil {
+		return nil, err
+	}
+	l.allowCountries = countrySet(a.AllowCountries)
+	l.denyCountries = countrySet(a.DenyCountries)
+	if geo == nil && (len(l.allowCountries) > 0 || len(l.denyCountries) > 0) {
+		return nil, fmt.Errorf("country rules need a GeoIPDatabase")
+	}
+	l.restricted = len(a.Allow) > 0 || len(a.AllowFiles) > 0 || len(l.allowCountries) > 0
+	return l, nil
+}
+
+// permit reports whether ip may connect. A nil acl permits everything, and
+// an unknown ip everything not restricted to an allow list.
+func (l *acl) permit(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	if ip == nil {
+		return !l.restricted
+	}
+	if containsIP(l.deny, ip) {
+		return false
+	}
+	country := l.country(ip)
+	if l.denyCountries[country] {
+		return false
+	}
+	if !l.restricted {
+		return true
+	}
+	return containsIP(l.allow, ip) || l.allowCountries[country]
+}
+
+func (l *acl) country(ip net.IP) string {
+	if l.geo == nil || (len(l.allowCountries) == 0 && len(l.denyCountries) == 0) {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.geo.Lookup(ip, &record); err != nil {
+		log.Debugf("Look up country of %v error: %v", ip, err)
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// geoIP is a MaxMind format database loaded from path.
+type geoIP struct {
+	path    string
+	modTime time.Time
+	size    int64
+	reader  *maxminddb.Reader
+}
+
+// openGeoIP loads a MaxMind format database into memory, so a reload can
+// drop the old one while connections still use it. It returns old instead
+// if that was loaded from the same, unchanged file.
+func openGeoIP(path string, old *geoIP) (*geoIP, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && old.path == path && old.modTime.Equal(info.ModTime()) && old.size == info.Size() {
+		return old, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{path: path, modTime: info.ModTime(), size: info.Size(), reader: reader}, nil
+}
+
+func parseNets(entries []string, files []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			entry := scanner.Text()
+			if i := strings.IndexByte(entry, '#'); i >= 0 {
+				entry = entry[:i]
+			}
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			n, err := parseNet(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			nets = append(nets, n)
+		}
+	}
+	for _, entry := range entries {
+		n, err := parseNet(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseNet accepts a CIDR or a single address.
+func parseNet(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		return n, err
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range codes {
+		set[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	return set
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNets(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nets.txt")
+	writeConfig(t, file, "# office\n192.0.2.1\n\n  198.51.100.0/24  # vpn\n2001:db8::/32\n")
+	nets, err := parseNets([]string{" 203.0.113.7 ", "2001:db8:1::1"}, []string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	want := "192.0.2.1/32 198.51.100.0/24 2001:db8::/32 203.0.113.7/32 2001:db8:1::1/128"
+	if strings.Join(got, " ") != want {
+		t.Errorf("nets %s, want %s", strings.Join(got, " "), want)
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	writeConfig(t, bad, "192.0.2.1\n192.0.2.300 # typo\n")
+	tests := []struct {
+		entries []string
+		files   []string
+		// fail is part of the error.
+		fail string
+	}{
+		{[]string{"example.com"}, nil, `invalid address "example.com"`},
+		{[]string{"192.0.2.0/33"}, nil, "invalid CIDR"},
+		{nil, []string{bad}, bad + ":2: invalid address"},
+		{nil, []string{filepath.Join(dir, "missing.txt")}, "missing.txt"},
+	}
+	for _, test := range tests {
+		_, err := parseNets(test.entries, test.files)
+		if err == nil || !strings.Contains(err.Error(), test.fail) {
+			t.Errorf("parseNets(%q, %q) error %v, want %q", test.entries, test.files, err, test.fail)
+		}
+	}
+}
+
+// writeGeoIP writes a MaxMind format IPv4 database placing 0.0.0.0/1 in
+// country DE and knowing nothing about the rest.
+func writeGeoIP(t *testing.T, path string) {
+	t.Helper()
+	var db []byte
+	// One node of two 24 bit records: the left one points to the data
+	// (node count + 16 + offset 0), the right one is empty (node count).
+	db = append(db, 0x00, 0x00, 0x11, 0x00, 0x00, 0x01)
+	db = append(db, make([]byte, 16)...)
+	// {"country": {"iso_code": "DE"}}
+	db = append(db, 0xe1, 0x47)
+	db = append(db, "country"...)
+	db = append(db, 0xe1, 0x48)
+	db = append(db, "iso_code"...)
+	db = append(db, 0x42, 'D', 'E')
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	// {"node_count": 1, "record_size": 24, "ip_version": 4}
+	db = append(db, 0xe3, 0x4a)
+	db = append(db, "node_count"...)
+	db = append(db, 0xc1, 0x01, 0x4b)
+	db = append(db, "record_size"...)
+	db = append(db, 0xa1, 0x18, 0x4a)
+	db = append(db, "ip_version"...)
+	db = append(db, 0xa1, 0x04)
+	if err := ioutil.WriteFile(path, db, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACLPermit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	writeGeoIP(t, path)
+	geo, err := openGeoIP(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		access Access
+		// permitted and refused are the addresses expected to be let
+		// through and refused.
+		permitted, refused []string
+	}{
+		{"deny only", Access{Deny: []string{"192.0.2.0/24"}},
+			[]string{"198.51.100.1", "2001:db8::1"}, []string{"192.0.2.1"}},
+		{"allow only", Access{Allow: []string{"192.0.2.0/24", "2001:db8::/32"}},
+			[]string{"192.0.2.1", "2001:db8::1"}, []string{"198.51.100.1", "2001:db9::1"}},
+		{"deny over allow", Access{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25"}},
+			[]string{"192.0.2.1"}, []string{"192.0.2.200", "198.51.100.1"}},
+		{"deny country", Access{DenyCountries: []string{"de"}},
+			[]string{"198.51.100.1"}, []string{"10.0.0.1"}},
+		{"allow country", Access{AllowCountries: []string{"DE"}},
+			[]string{"10.0.0.1"}, []string{"198.51.100.1"}},
+		{"allow country or address", Access{AllowCountries: []string{"DE"}, Allow: []string{"198.51.100.1"}},
+			[]string{"10.0.0.1", "198.51.100.1"}, []string{"198.51.100.2"}},
+		{"deny over allow country", Access{AllowCountries: []string{"DE"}, Deny: []string{"10.0.0.0/8"}},
+			[]string{"11.0.0.1"}, []string{"10.0.0.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := test.access.compile(geo.reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range test.permitted {
+				if !l.permit(net.ParseIP(ip)) {
+					t.Errorf("%s refused", ip)
+				}
+			}
+			for _, ip := range test.refused {
+				if l.permit(net.ParseIP(ip)) {
+					t.Errorf("%s permitted", ip)
+				}
+			}
+			// A client of unknown address is only refused by allow lists.
+			if got, want := l.permit(nil), !l.restricted; got != want {
+				t.Errorf("unknown address permitted = %v, want %v", got, want)
+			}
+		})
+	}
+	var none *acl
+	if !none.permit(net.ParseIP("192.0.2.1")) {
+		t.Error("nil acl refused a client")
+	}
+	if _, err := (&Access{AllowCountries: []string{"DE"}}).compile(nil); err == nil {
+		t.Error("country rules accepted without a GeoIP database")
+	}
+}
+
+func TestOpenGeoIPReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	writeGeoIP(t, path)
+	geo, err := openGeoIP(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := openGeoIP(path, geo); err != nil || again != geo {
+		t.Errorf("unchanged database loaded again: %v", err)
+	}
+	// An update of the file is loaded.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := openGeoIP(path, geo); err != nil || updated == geo {
+		t.Errorf("updated database not loaded: %v", err)
+	}
+	if _, err := openGeoIP(filepath.Join(filepath.Dir(path), "missing.mmdb"), geo); err == nil {
+		t.Error("missing database opened")
+	}
+
+	// A reload keeps the database of the running config.
+	config := filepath.Join(filepath.Dir(path), "config.json")
+	writeConfig(t, config, `{"GeoIPDatabase": "`+path+`", "Access": {"DenyCountries": ["DE"]}}`)
+	running, err := LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(config, running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.geo != running.geo || c.acl.geo != running.geo.reader {
+		t.Error("reload loaded the unchanged database again")
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/Catofes/SniGateway/certs"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Config is the gateway configuration file. Everything except the
+// listeners can be changed by reloading it.
+type Config struct {
+	// The top level rule set is used by listeners that name none.
+	RuleSet
+	RuleSets  map[string]*RuleSet
+	Listeners []Listener
+	// ListenAddress, ListenPort and AcceptProxyProtocol describe the only
+	// listener when Listeners is empty.
+	ListenAddress       string
+	ListenPort          int
+	AcceptProxyProtocol bool
+	// MaxHelloSize bounds the bytes buffered while waiting for a complete
+	// ClientHello. HelloTimeout is the deadline in seconds for receiving it.
+	MaxHelloSize int
+	HelloTimeout int
+	// Watch reloads the config whenever the file changes on disk, in
+	// addition to on SIGHUP.
+	Watch bool
+	// MetricsAddress serves Prometheus metrics on /metrics when set. It is
+	// only read at startup.
+	MetricsAddress string
+	// DrainTimeout is how long, in seconds, open connections may keep
+	// running after SIGINT or SIGTERM before they are closed.
+	DrainTimeout int
+	// Certificates are shared by the terminating routes without their own
+	// certificate. Only Hosts is applied on reload.
+	Certificates certs.Config
+	// Limits bound the connections accepted overall and per source.
+	Limits Limits
+	// Access restricts the clients of every listener, and GeoIPDatabase is
+	// a MaxMind format database for the country rules of Access.
+	Access        *Access
+	GeoIPDatabase string
+	acl           *acl
+	geo           *geoIP
+}
+
+// RuleSet is an ordered list of rules with its fallback routes.
+type RuleSet struct {
+	Rules Rules
+	// Default is used when no rule matches, NoSNI when the ClientHello has
+	// no server_name. Either may be a backend address or "reject".
+	Default Fallback
+	NoSNI   Fallback
+	router  *Router
+}
+
+// Listener is one address the gateway accepts connections on.
+type Listener struct {
+	Address string
+	Port    int
+	// RuleSet names an entry of Config.RuleSets, empty for the top level
+	// rules.
+	RuleSet string
+	// AcceptProxyProtocol expects every accepted connection to start with a
+	// PROXY protocol header, for running behind a load balancer.
+	AcceptProxyProtocol bool
+}
+
+func (l *Listener) String() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// LoadConfig reads and fully validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, nil)
+}
+
+// loadConfig is LoadConfig reusing the GeoIP database of the running config
+// if the file is unchanged.
+func loadConfig(path string, running *Config) (*Config, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(f, c); err != nil {
+		return nil, err
+	}
+	if len(c.Listeners) == 0 {
+		c.Listeners = []Listener{{
+			Address:             c.ListenAddress,
+			Port:                c.ListenPort,
+			AcceptProxyProtocol: c.AcceptProxyProtocol,
+		}}
+	}
+	var geo *maxminddb.Reader
+	if c.GeoIPDatabase != "" {
+		var old *geoIP
+		if running != nil {
+			old = running.geo
+		}
+		if c.geo, err = openGeoIP(c.GeoIPDatabase, old); err != nil {
+			return nil, fmt.Errorf("GeoIP database: %s", err)
+		}
+		geo = c.geo.reader
+	}
+	if c.Access != nil {
+		if c.acl, err = c.Access.compile(geo); err != nil {
+			return nil, fmt.Errorf("access: %s", err)
+		}
+	}
+	for name, set := range c.ruleSets() {
+		if err := set.compile(name, geo); err != nil {
+			return nil, fmt.Errorf("rule set %q: %s", name, err)
+		}
+	}
+	for _, l := range c.Listeners {
+		if c.RuleSetByName(l.RuleSet) == nil {
+			return nil, fmt.Errorf("listener %s: unknown rule set %q", l.String(), l.RuleSet)
+		}
+	}
+	if err := c.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("limits: %s", err)
+	}
+	if c.MaxHelloSize <= 0 {
+		c.MaxHelloSize = defaultMaxHelloSize
+	}
+	if c.HelloTimeout <= 0 {
+		c.HelloTimeout = defaultHelloTimeout
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = defaultDrainTimeout
+	}
+	return c, nil
+}
+
+// ruleSets returns every rule set by name, the top level one as "".
+func (c *Config) ruleSets() map[string]*RuleSet {
+	sets := map[string]*RuleSet{"": &c.RuleSet}
+	for name, set := range c.RuleSets {
+		if name != "" && set != nil {
+			sets[name] = set
+		}
+	}
+	return sets
+}
+
+// RuleSetByName returns the named rule set, or nil if there is none.
+func (c *Config) RuleSetByName(name string) *RuleSet {
+	if name == "" {
+		return &c.RuleSet
+	}
+	return c.RuleSets[name]
+}
+
+// compile prepares the rule set called name.
+func (r *RuleSet) compile(name string, geo *maxminddb.Reader) error {
+	var err error
+	if r.router, err = NewRouter(r.Rules); err != nil {
+		return fmt.Errorf("invalid rules: %s", err)
+	}
+	r.Default.name = "default"
+	r.NoSNI.name = "no_sni"
+	for name, f := range map[string]*Fallback{"default": &r.Default, "no SNI": &r.NoSNI} {
+		if f.empty() {
+			continue
+		}
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("%s route: %s", name, err)
+		}
+	}
+	// Without SNI there is no name to verify the backend for.
+	if t := r.NoSNI.Terminate; t != nil && t.BackendTLS != nil && t.BackendTLS.ServerName == "" && !t.BackendTLS.Insecure {
+		return fmt.Errorf("no SNI route: BackendTLS needs a ServerName")
+	}
+	for _, route := range r.routes() {
+		// Every rule set has a "default" route and may repeat rule names.
+		route.label = route.name
+		if name != "" {
+			route.label = name + "/" + route.name
+		}
+		if route.Access != nil {
+			if route.acl, err = route.Access.compile(geo); err != nil {
+				return fmt.Errorf("route %s: access: %s", route.name, err)
+			}
+		}
+		if err := route.prepare(); err != nil {
+			return fmt.Errorf("route %s: %s", route.name, err)
+		}
+	}
+	return nil
+}
+
+func (r *RuleSet) routes() []*Route {
+	routes := []*Route{&r.Default.Route, &r.NoSNI.Route}
+	for i := range r.Rules {
+		routes = append(routes, &r.Rules[i].Route)
+	}
+	return routes
+}
+
+// Start begins the health checks of every backend pool and watching the
+// certificate files of terminating routes.
+func (c *Config) Start() {
+	for _, set := range c.ruleSets() {
+		for _, route := range set.routes() {
+			if route.pool != nil {
+				route.pool.Start()
+			}
+			if route.certs != nil {
+				if err := route.certs.Watch(); err != nil {
+					log.Warningf("Cannot watch certificate of %s. %s", route.name, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Stop ends what Start began.
+func (c *Config) Stop() {
+	for _, set := range c.ruleSets() {
+		for _, route := range set.routes() {
+			if route.pool != nil {
+				route.pool.Stop()
+			}
+			if route.certs != nil {
+				route.certs.Close()
+			}
+		}
+	}
+}
+
+// pools returns the backend pools of every route.
+func (c *Config) pools() []*Pool {
+	var pools []*Pool
+	for _, set := range c.ruleSets() {
+		for _, route := range set.routes() {
+			if route.pool != nil {
+				pools = append(pools, route.pool)
+			}
+		}
+	}
+	return pools
+}
+
+// inheritHealth marks the backends old found down as down in c as well.
+// Call it before c.Start.
+func (c *Config) inheritHealth(old *Config) {
+	// A backend shared by routes is only down for the checks of the route
+	// that found it down.
+	down := make(map[[2]string]bool)
+	for _, p := range old.pools() {
+		p.collectDown(down)
+	}
+	for _, p := range c.pools() {
+		p.inherit(down)
+	}
+}
+
+// forgetBackends deletes the health metrics of the backends old checked
+// and c does not.
+func (c *Config) forgetBackends(old *Config) {
+	checked := make(map[[2]string]bool)
+	for _, p := range c.pools() {
+		if p.check != nil {
+			for _, b := range p.backends {
+				checked[[2]string{p.route, b.address}] = true
+			}
+		}
+	}
+	for _, p := range old.pools() {
+		if p.check == nil {
+			continue
+		}
+		for _, b := range p.backends {
+			if !checked[[2]string{p.route, b.address}] {
+				backendUp.DeleteLabelValues(p.route, b.address)
+			}
+		}
+	}
+}
+
+// GetRoute returns the route for sni and the offered ALPN protocols,
+// falling back to Default.
+func (r *RuleSet) GetRoute(sni string, alpn []string) *Route {
+	if rule := r.router.Lookup(sni, alpn); rule != nil {
+		return &rule.Route
+	}
+	return &r.Default.Route
+}
+
+// Fallback is a Route that may also be written as a bare backend address.
+type Fallback struct {
+	Route
+}
+
+func (f *Fallback) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Backend); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &f.Route)
+}
+
+// Diff describes how the routes of c differ from old, one line per change.
+func (c *Config) Diff(old *Config) []string {
+	var changes []string
+	oldSets := old.ruleSets()
+	newSets := c.ruleSets()
+	for _, name := range setNames(oldSets, newSets) {
+		prefix := ""
+		if name != "" {
+			prefix = name + ": "
+		}
+		oldSet, newSet := oldSets[name], newSets[name]
+		if oldSet == nil {
+			oldSet = &RuleSet{}
+		}
+		if newSet == nil {
+			newSet = &RuleSet{}
+		}
+		for _, change := range newSet.Diff(oldSet) {
+			changes = append(changes, prefix+change)
+		}
+	}
+	return changes
+}
+
+func setNames(sets ...map[string]*RuleSet) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range sets {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Diff describes how the routes of r differ from old, one line per change.
+func (r *RuleSet) Diff(old *RuleSet) []string {
+	var changes []string
+	oldRoutes := old.routeMap()
+	newRoutes := r.routeMap()
+	for _, key := range old.routeKeys() {
+		if _, ok := newRoutes[key]; !ok {
+			changes = append(changes, fmt.Sprintf("removed %s -> %s", key, oldRoutes[key]))
+		}
+	}
+	for _, key := range r.routeKeys() {
+		backend, ok := oldRoutes[key]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added %s -> %s", key, newRoutes[key]))
+		case backend != newRoutes[key]:
+			changes = append(changes, fmt.Sprintf("changed %s -> %s (was %s)", key, newRoutes[key], backend))
+		}
+	}
+	return changes
+}
+
+// routeKeys lists the routes of r in rule order, followed by the fallbacks.
+func (r *RuleSet) routeKeys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, rule := range r.Rules {
+		key := rule.key()
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if !r.Default.empty() {
+		keys = append(keys, "default")
+	}
+	if !r.NoSNI.empty() {
+		keys = append(keys, "no SNI")
+	}
+	return keys
+}
+
+func (r *RuleSet) routeMap() map[string]string {
+	routes := make(map[string]string)
+	for _, rule := range r.Rules {
+		key := rule.key()
+		if _, ok := routes[key]; !ok {
+			routes[key] = rule.Route.String()
+		}
+	}
+	if !r.Default.empty() {
+		routes["default"] = r.Default.String()
+	}
+	if !r.NoSNI.empty() {
+		routes["no SNI"] = r.NoSNI.String()
+	}
+	return routes
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits bound the connections the gateway handles. Zero means unlimited.
+// Connections over a limit are closed right away, before anything is read
+// from them.
+type Limits struct {
+	// MaxConnections caps the concurrent connections over all listeners.
+	MaxConnections int
+	// MaxPerSource caps the concurrent connections from one source, and
+	// Rate with Burst is a token bucket of new connections per second from
+	// one source. A source is an IPv4 address or IPv6 /64 unless
+	// IPv4Prefix or IPv6Prefix group more of them.
+	MaxPerSource int
+	Rate         float64
+	Burst        int
+	IPv4Prefix   int
+	IPv6Prefix   int
+}
+
+const (
+	reasonMaxConnections = "max_connections"
+	reasonMaxPerSource   = "max_per_source"
+	reasonRate           = "rate"
+	reasonRouteMax       = "route_max_connections"
+
+	// sweepInterval is how often sources without connections and with a
+	// full bucket are forgotten.
+	sweepInterval = time.Minute
+)
+
+func (l *Limits) validate() error {
+	switch {
+	case l.MaxConnections < 0, l.MaxPerSource < 0, l.Rate < 0, l.Burst < 0:
+		return errors.New("limits must not be negative")
+	case l.IPv4Prefix < 0 || l.IPv4Prefix > 32:
+		return fmt.Errorf("invalid IPv4Prefix %d", l.IPv4Prefix)
+	case l.IPv6Prefix < 0 || l.IPv6Prefix > 128:
+		return fmt.Errorf("invalid IPv6Prefix %d", l.IPv6Prefix)
+	}
+	return nil
+}
+
+// limiter counts connections for Limits and the MaxConnections of routes.
+// It is kept across reloads, so the counts stay right while the limits
+// change.
+type limiter struct {
+	mu        sync.Mutex
+	total     int
+	sources   map[string]*source
+	routes    map[string]int
+	lastSweep time.Time
+}
+
+type source struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+// acquire admits a new connection from ip, counting it against
+// MaxConnections if global and against the source limits unless ip is nil.
+// It returns a func to call when the connection is done, or the reason it
+// was refused.
+func (l *limiter) acquire(limits *Limits, ip net.IP, global bool) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if global && limits.MaxConnections > 0 && l.total >= limits.MaxConnections {
+		return nil, reasonMaxConnections
+	}
+	var src *source
+	if ip != nil && (limits.MaxPerSource > 0 || limits.Rate > 0) {
+		if l.sources == nil {
+			l.sources = make(map[string]*source)
+		}
+		if now.Sub(l.lastSweep) > sweepInterval {
+			l.sweep(limits, now)
+		}
+		key := sourceKey(limits, ip)
+		src = l.sources[key]
+		if src == nil {
+			src = &source{tokens: float64(burst(limits)), last: now}
+			l.sources[key] = src
+		}
+		if limits.MaxPerSource > 0 && src.active >= limits.MaxPerSource {
+			return nil, reasonMaxPerSource
+		}
+		if limits.Rate > 0 {
+			src.refill(limits, now)
+			if src.tokens < 1 {
+				return nil, reasonRate
+			}
+			src.tokens--
+		}
+		src.active++
+	}
+	if global {
+		l.total++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if global {
+				l.total--
+			}
+			if src != nil {
+				src.active--
+			}
+		})
+	}, ""
+}
+
+// acquireRoute admits a connection to the route with label key, allowing
+// at most max at once.
+func (l *limiter) acquireRoute(key string, max int) (func(), bool) {
+	if max <= 0 {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.routes == nil {
+		l.routes = make(map[string]int)
+	}
+	if l.routes[key] >= max {
+		return nil, false
+	}
+	l.routes[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.routes[key]--; l.routes[key] == 0 {
+				delete(l.routes, key)
+			}
+		})
+	}, true
+}
+
+func (l *limiter) sweep(limits *Limits, now time.Time) {
+	l.lastSweep = now
+	for key, src := range l.sources {
+		if src.active > 0 {
+			continue
+		}
+		if limits.Rate > 0 {
+			src.refill(limits, now)
+			if src.tokens < float64(burst(limits)) {
+				continue
+			}
+		}
+		delete(l.sources, key)
+	}
+}
+
+func (s *source) refill(limits *Limits, now time.Time) {
+	s.tokens = math.Min(float64(burst(limits)), s.tokens+now.Sub(s.last).Seconds()*limits.Rate)
+	s.last = now
+}
+
+func burst(limits *Limits) int {
+	if limits.Burst > 0 {
+		return limits.Burst
+	}
+	return int(math.Max(1, math.Ceil(limits.Rate)))
+}
+
+// sourceKey is the network of ip that is limited as one source.
+func sourceKey(limits *Limits, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix := limits.IPv4Prefix
+		if prefix == 0 {
+			prefix = 32
+		}
+		return ip4.Mask(net.CIDRMask(prefix, 32)).String()
+	}
+	prefix := limits.IPv6Prefix
+	if prefix == 0 {
+		prefix = 64
+	}
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
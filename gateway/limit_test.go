@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteLimitsPerRuleSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"Default": {"Backend": "10.0.0.1:443", "MaxConnections": 1},
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.2:443", "MaxConnections": 1}],
+		"RuleSets": {"other": {
+			"Default": {"Backend": "10.0.0.3:443", "MaxConnections": 1},
+			"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.4:443", "MaxConnections": 1}]
+		}}
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l limiter
+	var routes []*Route
+	for _, set := range []*RuleSet{&c.RuleSet, c.RuleSets["other"]} {
+		routes = append(routes, set.GetRoute("a.com", nil), set.GetRoute("b.com", nil))
+	}
+	labels := []string{"exact:a.com", "default", "other/exact:a.com", "other/default"}
+	for i, route := range routes {
+		if route.label != labels[i] {
+			t.Errorf("route labelled %q, want %q", route.label, labels[i])
+		}
+	}
+	var releases []func()
+	for _, route := range routes {
+		release, ok := l.acquireRoute(route.label, route.MaxConnections)
+		if !ok {
+			t.Fatalf("route %s refused its first connection", route.label)
+		}
+		releases = append(releases, release)
+	}
+	for _, route := range routes {
+		if _, ok := l.acquireRoute(route.label, route.MaxConnections); ok {
+			t.Errorf("route %s admitted a second connection", route.label)
+		}
+	}
+	releases[0]()
+	releases[0]()
+	if _, ok := l.acquireRoute(routes[0].label, 1); !ok {
+		t.Error("released route still full")
+	}
+	if _, ok := l.acquireRoute(routes[1].label, 1); ok {
+		t.Error("releasing twice freed another route")
+	}
+}
+
+func TestLimiterSources(t *testing.T) {
+	limits := &Limits{MaxConnections: 3, MaxPerSource: 2, IPv6Prefix: 48}
+	var l limiter
+	acquire := func(ip string) string {
+		_, reason := l.acquire(limits, net.ParseIP(ip), true)
+		return reason
+	}
+	for _, step := range []struct {
+		ip, reason string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.1", reasonMaxPerSource},
+		{"2001:db8:1:1::1", ""},
+		{"2001:db8:1:2::1", reasonMaxConnections},
+	} {
+		if got := acquire(step.ip); got != step.reason {
+			t.Errorf("acquire %s refused with %q, want %q", step.ip, got, step.reason)
+		}
+	}
+	limits.MaxConnections = 0
+	if got := acquire("2001:db8:1:2::1"); got != "" {
+		t.Errorf("second address of the /48 refused with %q", got)
+	}
+	if got := acquire("2001:db8:1:3::1"); got != reasonMaxPerSource {
+		t.Errorf("third address of the /48 refused with %q, want %q", got, reasonMaxPerSource)
+	}
+}
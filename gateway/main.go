@@ -2,14 +2,16 @@ package main
 
 import (
 	"github.com/op/go-logging"
-	"errors"
+	"github.com/Catofes/SniGateway/certs"
+	"github.com/Catofes/SniGateway/clienthello"
+	"github.com/Catofes/SniGateway/drain"
+	"github.com/Catofes/SniGateway/proxyproto"
 	"net"
+	"errors"
 	"io"
 	"os"
-	"regexp"
-	"encoding/json"
-	"io/ioutil"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"flag"
 	"time"
 )
@@ -28,217 +30,311 @@ func init() {
 }
 
 const (
-	extensionServerName uint16 = 0
+	defaultMaxHelloSize = 64 * 1024
+	defaultHelloTimeout = 10
+	defaultDrainTimeout = 30
+	// backendReject as a backend answers with an unrecognized_name alert.
+	backendReject = "reject"
 )
 
-var (
-	log                   *logging.Logger
-	errInvaildClientHello error = errors.New("Invalid TLS ClientHello data")
-)
+var log *logging.Logger
 
 type SNIHandler struct {
-	Rules         []map[string]string
-	ListenAddress string
-	ListenPort    int
+	path      string
+	config    atomic.Value
+	listeners []net.Listener
+	tracker   drain.Tracker
+	limiter   limiter
 }
 
-func (s *SNIHandler) ParseSNI(data []byte) (host string, err error) {
-	//TLS Package Type
-	if data[0] != 0x16 {
-		return "", errInvaildClientHello
-	}
-	//TLS Version
-	versionBytes := data[1:3]
-	if versionBytes[0] < 3 || (versionBytes[0] == 3 && versionBytes[1] < 1) {
-		return "", errInvaildClientHello
-	}
+// Config returns the config currently in effect.
+func (s *SNIHandler) Config() *Config {
+	return s.config.Load().(*Config)
+}
 
-	//Handshake Message
-	data = data[5:]
-	if len(data) < 42 {
-		return "", errInvaildClientHello
-	}
-	if data[0] != 0x1 {
-		return "", errInvaildClientHello
-	}
-	sessionIdLen := int(data[38])
-	if sessionIdLen > 32 || len(data) < 39+sessionIdLen {
-		return "", errInvaildClientHello
-	}
-	data = data[39+sessionIdLen:]
-	if len(data) < 2 {
-		return "", errInvaildClientHello
-	}
-	cipherSuiteLen := int(data[0])<<8 | int(data[1])
-	if cipherSuiteLen%2 == 1 || len(data) < 2+cipherSuiteLen {
-		return "", errInvaildClientHello
+func (s *SNIHandler) Init(path string) *SNIHandler {
+	c, err := LoadConfig(path)
+	if err != nil {
+		log.Fatalf("Cannot load config file. %s", err.Error())
 	}
-	data = data[2+cipherSuiteLen:]
-	if len(data) < 1 {
-		return "", errInvaildClientHello
+	s.path = path
+	certConfig := c.Certificates
+	certConfig.Hosts = c.acmeHosts()
+	if certManager, err = certs.NewManager(certConfig); err != nil {
+		log.Fatalf("Cannot load certificates. %s", err.Error())
 	}
-	compressionMethodsLen := int(data[0])
-	if len(data) < 1+compressionMethodsLen {
-		return "", errInvaildClientHello
+	if err := certManager.Start(); err != nil {
+		log.Fatalf("Cannot watch certificates. %s", err.Error())
 	}
-	data = data[1+compressionMethodsLen:]
-	serverName := ""
+	c.Start()
+	s.config.Store(c)
+	return s
+}
 
-	if len(data) == 0 {
-		// ClientHello is optionally followed by extension data
-		return "", nil
+// Pipe copies between the client a and the backend b until both sides are
+// done, returning the bytes sent up to b and down to a.
+func (s *SNIHandler) Pipe(a, b net.Conn) (up, down int64, err error) {
+	type result struct {
+		n   int64
+		err error
 	}
-	if len(data) < 2 {
-		return "", errInvaildClientHello
+	upDone := make(chan result, 1)
+	downDone := make(chan result, 1)
+	cp := func(r, w net.Conn, done chan result) {
+		n, err := io.Copy(w, r)
+		log.Debugf("copied %d bytes from %s to %s", n, r.RemoteAddr(), w.RemoteAddr())
+		if wc, ok := w.(interface{ CloseWrite() error }); ok {
+			wc.CloseWrite()
+		}
+		if rc, ok := r.(interface{ CloseRead() error }); ok {
+			rc.CloseRead()
+		}
+		done <- result{n, err}
 	}
-	extensionsLength := int(data[0])<<8 | int(data[1])
-	data = data[2:]
-	if extensionsLength != len(data) {
-		return "", errInvaildClientHello
+	go cp(a, b, upDone)
+	go cp(b, a, downDone)
+	r1 := <-upDone
+	r2 := <-downDone
+	log.Debugf("Finish.")
+	if r1.err != nil {
+		return r1.n, r2.n, r1.err
 	}
+	return r1.n, r2.n, r2.err
+}
 
-	for len(data) != 0 {
-		if len(data) < 4 {
-			return "", errInvaildClientHello
+func (s *SNIHandler) Handle(lc net.Conn, l *Listener) {
+	log.Debugf("Handle connection %v on %v\n", lc.RemoteAddr(), l)
+	defer lc.Close()
+	acceptedConnections.WithLabelValues(l.String()).Inc()
+	c := s.Config()
+	rules := c.RuleSetByName(l.RuleSet)
+	if rules == nil {
+		log.Warningf("Rule set %q of %v was removed, close %v\n", l.RuleSet, l, lc.RemoteAddr())
+		return
+	}
+	lc.SetReadDeadline(time.Now().Add(time.Duration(c.HelloTimeout) * time.Second))
+	if l.AcceptProxyProtocol {
+		pc, err := proxyproto.NewConn(lc)
+		if err != nil {
+			parseFailures.WithLabelValues(failureReason(err)).Inc()
+			log.Warningf("Read PROXY header from %v error: %v\n", lc.RemoteAddr(), err)
+			return
 		}
-		extension := uint16(data[0])<<8 | uint16(data[1])
-		length := int(data[2])<<8 | int(data[3])
-		data = data[4:]
-		if len(data) < length {
-			return "", errInvaildClientHello
+		lc = pc
+		// The source limits apply to the client behind the load balancer.
+		release, reason := s.limiter.acquire(&c.Limits, addrIP(pc.RemoteAddr()), false)
+		if release == nil {
+			rejectedConnections.WithLabelValues(reason).Inc()
+			log.Debugf("Close %v, over %s limit", lc.RemoteAddr(), reason)
+			return
 		}
+		defer release()
+	}
+	ip := addrIP(lc.RemoteAddr())
+	if !c.acl.permit(ip) {
+		rejectedConnections.WithLabelValues(reasonAccessDenied).Inc()
+		log.Debugf("Close %v, access denied", lc.RemoteAddr())
+		return
+	}
+	hello, b, err := clienthello.Read(lc, c.MaxHelloSize)
+	if err != nil {
+		parseFailures.WithLabelValues(failureReason(err)).Inc()
+		log.Warningf("Read ClientHello from %v error: %v\n", lc.RemoteAddr(), err)
+		return
+	}
+	lc.SetReadDeadline(time.Time{})
 
-		switch extension {
-		case extensionServerName:
-			d := data[:length]
-			if len(d) < 2 {
-				return "", errInvaildClientHello
-			}
-			namesLen := int(d[0])<<8 | int(d[1])
-			d = d[2:]
-			if len(d) != namesLen {
-				return "", errInvaildClientHello
-			}
-			for len(d) > 0 {
-				if len(d) < 3 {
-					return "", errInvaildClientHello
-				}
-				nameType := d[0]
-				nameLen := int(d[1])<<8 | int(d[2])
-				d = d[3:]
-				if len(d) < nameLen {
-					return "", errInvaildClientHello
-				}
-				if nameType == 0 {
-					serverName = string(d[:nameLen])
-					break
-				}
-				d = d[nameLen:]
-			}
+	var route *Route
+	if hello.ServerName == "" {
+		route = &rules.NoSNI.Route
+		log.Debugf("No SNI from %v, use %v", lc.RemoteAddr(), route)
+	} else {
+		route = rules.GetRoute(hello.ServerName, hello.ALPNProtocols)
+		log.Debugf("ParseSNI get %v, use %v", hello.ServerName, route)
+		if route == &rules.Default.Route {
+			unmatchedSNIs.WithLabelValues(sniLabel(hello.ServerName)).Inc()
 		}
-		data = data[length:]
 	}
-	return serverName, nil
-}
+	if !route.empty() {
+		routedConnections.WithLabelValues(route.label, sniLabel(hello.ServerName)).Inc()
+	}
 
-func (s *SNIHandler) GetServer(sni string) string {
-	for _, ruleSet := range s.Rules {
-		for reg, value := range ruleSet {
-			if ok, _ := regexp.MatchString(reg, sni); ok {
-				return value
-			}
+	switch {
+	case !route.acl.permit(ip):
+		rejectedConnections.WithLabelValues(reasonAccessDenied).Inc()
+		log.Debugf("Close %v, access to %v denied", lc.RemoteAddr(), route.label)
+	case route.empty():
+		log.Warningf("No route for %q from %v\n", hello.ServerName, lc.RemoteAddr())
+	case route.Backend == backendReject:
+		s.Reject(lc, b)
+	default:
+		release, ok := s.limiter.acquireRoute(route.label, route.MaxConnections)
+		if !ok {
+			rejectedConnections.WithLabelValues(reasonRouteMax).Inc()
+			log.Debugf("Close %v, route %v is full", lc.RemoteAddr(), route.label)
+			return
 		}
+		defer release()
+		s.Forward(lc, route, hello, b)
 	}
-	return ""
 }
 
-func (s *SNIHandler) Init(path string) *SNIHandler {
-	f, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Fatalf("Cannot open config file. %s", err.Error())
+// Reject sends a fatal unrecognized_name alert, using the record version
+// the client sent its ClientHello with.
+func (s *SNIHandler) Reject(lc net.Conn, hello []byte) {
+	alert := []byte{0x15, hello[1], hello[2], 0x00, 0x02, 0x02, 0x70}
+	lc.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := lc.Write(alert); err != nil {
+		log.Debugf("Write alert to %v error: %v", lc.RemoteAddr(), err)
 	}
-	json.Unmarshal(f, s)
-	return s
 }
 
-func (s *SNIHandler) Pipe(a, b net.Conn) error {
-	done := make(chan error, 1)
-	cp := func(r, w net.Conn) {
-		n, err := io.Copy(w, r)
-		log.Debugf("copied %d bytes from %s to %s", n, r.RemoteAddr(), w.RemoteAddr())
-		w.(*net.TCPConn).CloseWrite()
-		r.(*net.TCPConn).CloseRead()
-		done <- err
-	}
-	go cp(a, b)
-	go cp(b, a)
-	err1 := <-done
-	log.Debugf("Done1.")
-	err2 := <-done
-	log.Debugf("Finish.")
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
+func (s *SNIHandler) Forward(lc net.Conn, route *Route, hello *clienthello.ClientHello, b []byte) {
+	var client net.Conn = lc
+	if route.Terminate != nil {
+		timeout := time.Duration(s.Config().HelloTimeout) * time.Second
+		tc, err := route.terminate(lc, b, timeout)
+		if err != nil {
+			log.Warningf("TLS handshake with %v error: %v\n", lc.RemoteAddr(), err)
+			return
+		}
+		client, b = tc, nil
 	}
-	return nil
-}
-
-func (s *SNIHandler) Handle(lc net.Conn) {
-	log.Debugf("Handle connection %v\n", lc.RemoteAddr())
-	defer lc.Close()
-	var err error
-	b := make([]byte, 4096)
-	n, err := lc.Read(b)
+	rc, backend, err := route.pool.Dial(lc.RemoteAddr())
 	if err != nil {
-		log.Debugf("Read error: %v\n", err)
+		log.Warningf("No backend of %v reachable for %v\n", route, lc.RemoteAddr())
 		return
 	}
-	b = b[:n]
-
-	host, err := GetHostname(b[:])
-	if err != nil {
-		log.Warningf("ParseSNI error: %v\n", err)
-		return
+	log.Debugf("Dial to %v", backend.address)
+	defer rc.Close()
+	defer s.tracker.Track(rc)()
+	if route.ProxyProtocol != 0 {
+		var tlvs []proxyproto.TLV
+		if hello.ServerName != "" {
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(hello.ServerName)})
+		}
+		header, err := proxyproto.Header(route.ProxyProtocol, lc.RemoteAddr(), lc.LocalAddr(), tlvs...)
+		if err != nil {
+			log.Warningf("Build PROXY header error: %v\n", err)
+			return
+		}
+		if route.backendTLS != nil {
+			// The header goes in front of the backend's TLS stream.
+			if _, err := rc.Write(header); err != nil {
+				log.Warningf("Write %v error: %v\n", rc, err)
+				return
+			}
+		} else {
+			b = append(header, b...)
+		}
 	}
-	log.Debugf("ParseSNI get %v", host)
-
-	if server := s.GetServer(host); server != "" {
-		log.Debugf("Dail to %v", server)
-		rc, err := net.DialTimeout("tcp", server, 2*time.Second)
+	if route.backendTLS != nil {
+		tc, err := route.encrypt(rc, hello.ServerName)
 		if err != nil {
-			log.Warningf("Dial %v error: %v\n", server, err)
+			log.Warningf("TLS handshake with backend %v error: %v\n", backend.address, err)
 			return
 		}
-		defer rc.Close()
+		rc = tc
+	}
+	if len(b) > 0 {
 		_, err = rc.Write(b)
-		log.Debugf("Write bytes %d to remote.", n)
+		log.Debugf("Write bytes %d to remote.", len(b))
 		if err != nil {
 			log.Warningf("Write %v error: %v\n", rc, err)
 			return
 		}
-		err = s.Pipe(lc, rc)
-		if err != nil {
-			log.Debugf("Pipe return error. %s", err.Error())
-		}
+	}
+	active := activeConnections.WithLabelValues(route.label)
+	active.Inc()
+	atomic.AddInt64(&backend.active, 1)
+	start := time.Now()
+	up, down, err := s.Pipe(client, rc)
+	atomic.AddInt64(&backend.active, -1)
+	active.Dec()
+	connectionDuration.WithLabelValues(route.label).Observe(time.Since(start).Seconds())
+	transferredBytes.WithLabelValues(route.label, "up").Add(float64(up + int64(len(b))))
+	transferredBytes.WithLabelValues(route.label, "down").Add(float64(down))
+	if err != nil {
+		log.Debugf("Pipe return error. %s", err.Error())
 	}
 }
 
+// StartListen serves every listener until SIGINT or SIGTERM, then shuts
+// down gracefully.
 func (s *SNIHandler) StartListen() {
-	listener, err := net.Listen("tcp", s.ListenAddress+":"+strconv.Itoa(s.ListenPort))
-	if err != nil {
-		log.Warningf("Couldn't start listening. %s", err.Error())
+	c := s.Config()
+	wg := &sync.WaitGroup{}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		listener, err := net.Listen("tcp", l.String())
+		if err != nil {
+			log.Warningf("Couldn't start listening on %v. %s", l, err.Error())
+			continue
+		}
+		log.Infof("Started proxy on %v -- listening", l)
+		s.listeners = append(s.listeners, listener)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(listener, l)
+		}()
+	}
+	if len(s.listeners) == 0 {
 		return
 	}
-	log.Infof("Started proxy on %s:%d -- listening", s.ListenAddress, s.ListenPort)
+	if c.MetricsAddress != "" {
+		go ServeMetrics(c.MetricsAddress)
+	}
+	go s.WatchReload()
+	sig := drain.WaitSignal()
+	log.Warningf("Received %v, shutting down.", sig)
+	s.Shutdown()
+	wg.Wait()
+}
+
+// Shutdown stops accepting, lets open connections finish for up to
+// DrainTimeout and then closes the rest.
+func (s *SNIHandler) Shutdown() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	c := s.Config()
+	summary := s.tracker.Drain(time.Duration(c.DrainTimeout) * time.Second)
+	c.Stop()
+	certManager.Close()
+	log.Warningf("Shutdown finished, %v.", summary)
+	for _, conn := range summary.Forced {
+		log.Warningf("Cut off %s", conn)
+	}
+}
+
+func (s *SNIHandler) serve(listener net.Listener, l *Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Warningf("Accept error. %s", err.Error())
 			continue
 		}
-		go s.Handle(conn)
+		// Behind a load balancer the source is only known after the PROXY
+		// header, so Handle checks it.
+		var ip net.IP
+		if !l.AcceptProxyProtocol {
+			ip = addrIP(conn.RemoteAddr())
+		}
+		release, reason := s.limiter.acquire(&s.Config().Limits, ip, true)
+		if release == nil {
+			rejectedConnections.WithLabelValues(reason).Inc()
+			log.Debugf("Close %v, over %s limit", conn.RemoteAddr(), reason)
+			conn.Close()
+			continue
+		}
+		s.tracker.Go(conn, func(conn net.Conn) {
+			defer release()
+			s.Handle(conn, l)
+		})
 	}
 }
 
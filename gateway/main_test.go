@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Catofes/SniGateway/clienthello"
+)
+
+// testBackend accepts connections and sends the server name of each
+// ClientHello it receives to the returned channel.
+func testBackend(t *testing.T) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	names := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hello, _, err := clienthello.Read(conn, 1<<16)
+				if err != nil {
+					names <- "error: " + err.Error()
+					return
+				}
+				names <- hello.ServerName
+			}()
+		}
+	}()
+	return ln.Addr().String(), names
+}
+
+// handshake starts sending a ClientHello for sni through s as accepted on
+// l, returning the client end of the connection.
+func handshake(s *SNIHandler, l *Listener, sni string) net.Conn {
+	a, b := net.Pipe()
+	go s.Handle(b, l)
+	go tls.Client(a, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+	return a
+}
+
+func TestListenerRuleSets(t *testing.T) {
+	public, publicNames := testBackend(t)
+	internal, internalNames := testBackend(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, fmt.Sprintf(`{
+		"Listeners": [
+			{"Address": "127.0.0.1", "Port": 8443},
+			{"Address": "127.0.0.1", "Port": 9443, "RuleSet": "internal"}
+		],
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": %q}],
+		"Default": "reject",
+		"RuleSets": {"internal": {
+			"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": %q}],
+			"Default": %q
+		}}
+	}`, public, internal, internal))
+	s := testHandler(t, path)
+	c := s.Config()
+
+	tests := []struct {
+		listener *Listener
+		sni      string
+		names    chan string
+	}{
+		{&c.Listeners[0], "a.com", publicNames},
+		{&c.Listeners[1], "a.com", internalNames},
+		{&c.Listeners[1], "b.com", internalNames},
+		// The top level Default rejects.
+		{&c.Listeners[0], "b.com", nil},
+	}
+	for _, test := range tests {
+		conn := handshake(s, test.listener, test.sni)
+		if test.names == nil {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, 7)
+			n, _ := conn.Read(reply)
+			reply = reply[:n]
+			conn.Close()
+			if len(reply) != 7 || reply[0] != 0x15 || reply[6] != 0x70 {
+				t.Errorf("%s on %v: reply %x, want an unrecognized_name alert", test.sni, test.listener, reply)
+			}
+			continue
+		}
+		select {
+		case name := <-test.names:
+			if name != test.sni {
+				t.Errorf("%s on %v: backend got %q", test.sni, test.listener, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s on %v: not forwarded to its rule set's backend", test.sni, test.listener)
+		}
+		conn.Close()
+	}
+	select {
+	case name := <-publicNames:
+		t.Errorf("public backend got %q from a listener of another rule set", name)
+	case name := <-internalNames:
+		t.Errorf("internal backend got %q from a listener of another rule set", name)
+	default:
+	}
+}
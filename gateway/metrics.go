@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"github.com/Catofes/SniGateway/clienthello"
+	"github.com/Catofes/SniGateway/proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxSNILabels caps the distinct SNI label values, so clients sending
+// random names cannot grow the metrics without bound.
+const maxSNILabels = 1000
+
+var (
+	acceptedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_accepted_connections_total",
+		Help: "Connections accepted, by listener.",
+	}, []string{"listener"})
+	parseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_parse_failures_total",
+		Help: "Connections closed before a ClientHello was read, by reason.",
+	}, []string{"reason"})
+	routedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_routed_connections_total",
+		Help: "Connections routed, by route and SNI.",
+	}, []string{"route", "sni"})
+	unmatchedSNIs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_unmatched_sni_total",
+		Help: "ClientHellos no rule matched, by SNI.",
+	}, []string{"sni"})
+	dialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_backend_dial_failures_total",
+		Help: "Failed backend dials, by route.",
+	}, []string{"route"})
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sni_gateway_backend_up",
+		Help: "Whether health checks consider a backend up, by route and backend.",
+	}, []string{"route", "backend"})
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sni_gateway_backend_dial_seconds",
+		Help:    "Time to connect to the backend, by route.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"route"})
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_transferred_bytes_total",
+		Help: "Bytes piped between client and backend, by route and direction.",
+	}, []string{"route", "direction"})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sni_gateway_active_connections",
+		Help: "Connections currently piped to a backend, by route.",
+	}, []string{"route"})
+	rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sni_gateway_rejected_connections_total",
+		Help: "Connections closed by a limit or access rule, by reason.",
+	}, []string{"reason"})
+	connectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sni_gateway_connection_duration_seconds",
+		Help:    "Lifetime of piped connections, by route.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"route"})
+
+	sniLabelsMutex sync.Mutex
+	sniLabels      = make(map[string]bool)
+)
+
+func init() {
+	prometheus.MustRegister(acceptedConnections, parseFailures, routedConnections, unmatchedSNIs,
+		dialFailures, backendUp, dialDuration, transferredBytes, activeConnections, connectionDuration, rejectedConnections)
+}
+
+// ServeMetrics serves the Prometheus metrics on addr.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Warningf("Metrics listener failed. %s", err.Error())
+	}
+}
+
+// sniLabel returns sni as a label value, or "other" once maxSNILabels
+// distinct names have been seen.
+func sniLabel(sni string) string {
+	if sni == "" {
+		return "none"
+	}
+	sniLabelsMutex.Lock()
+	defer sniLabelsMutex.Unlock()
+	if sniLabels[sni] {
+		return sni
+	}
+	if len(sniLabels) >= maxSNILabels {
+		return "other"
+	}
+	sniLabels[sni] = true
+	return sni
+}
+
+// failureReason names the error that stopped reading the ClientHello.
+func failureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, clienthello.ErrNotHandshake):
+		return "not_handshake"
+	case errors.Is(err, clienthello.ErrRecordVersion):
+		return "record_version"
+	case errors.Is(err, clienthello.ErrNotClientHello):
+		return "not_client_hello"
+	case errors.Is(err, clienthello.ErrTruncated):
+		return "truncated"
+	case errors.Is(err, clienthello.ErrMalformed):
+		return "malformed"
+	case errors.Is(err, clienthello.ErrTooLarge):
+		return "too_large"
+	case errors.Is(err, proxyproto.ErrNoHeader), errors.Is(err, proxyproto.ErrMalformed):
+		return "proxy_header"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	strategyRoundRobin = "round_robin"
+	strategyLeastConn  = "least_conn"
+	strategyRandom     = "random"
+	strategyHash       = "hash"
+
+	defaultDialTimeout = 2
+)
+
+// HealthCheck actively probes the backends of a pool. A backend is ejected
+// after Fall consecutive failed probes and admitted again after Rise
+// consecutive successful ones.
+type HealthCheck struct {
+	// Interval and Timeout are in seconds.
+	Interval int
+	Timeout  int
+	// TLS completes a TLS handshake, presenting ServerName, instead of only
+	// connecting.
+	TLS        bool
+	ServerName string
+	Fall       int
+	Rise       int
+}
+
+// Pool is the set of backends of a route.
+type Pool struct {
+	route    string
+	backends []*backend
+	strategy string
+	check    *HealthCheck
+	timeout  time.Duration
+	next     uint32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type backend struct {
+	address string
+	active  int64
+	down    int32
+}
+
+func (b *backend) healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+func NewPool(route *Route) (*Pool, error) {
+	addresses := route.Backends
+	if route.Backend != "" {
+		addresses = append([]string{route.Backend}, addresses...)
+	}
+	p := &Pool{
+		route:    route.label,
+		strategy: route.Strategy,
+		check:    route.HealthCheck,
+		timeout:  defaultDialTimeout * time.Second,
+	}
+	if route.DialTimeout > 0 {
+		p.timeout = time.Duration(route.DialTimeout) * time.Second
+	}
+	switch p.strategy {
+	case "":
+		p.strategy = strategyRoundRobin
+	case strategyRoundRobin, strategyLeastConn, strategyRandom, strategyHash:
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", route.Strategy)
+	}
+	for _, address := range addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid backend %q: %s", address, err)
+		}
+		p.backends = append(p.backends, &backend{address: address})
+	}
+	if c := p.check; c != nil {
+		if c.Interval <= 0 {
+			c.Interval = 10
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 2
+		}
+		if c.Fall <= 0 {
+			c.Fall = 3
+		}
+		if c.Rise <= 0 {
+			c.Rise = 2
+		}
+	}
+	return p, nil
+}
+
+// Dial connects to a backend chosen by the pool strategy. When that fails
+// it fails over to the next candidate, so the client only sees an error if
+// every backend is unreachable.
+func (p *Pool) Dial(client net.Addr) (net.Conn, *backend, error) {
+	err := errors.New("no backend")
+	for _, b := range p.candidates(client) {
+		start := time.Now()
+		conn, dialErr := net.DialTimeout("tcp", b.address, p.timeout)
+		if dialErr != nil {
+			dialFailures.WithLabelValues(p.route).Inc()
+			log.Warningf("Dial %v error: %v\n", b.address, dialErr)
+			err = dialErr
+			continue
+		}
+		dialDuration.WithLabelValues(p.route).Observe(time.Since(start).Seconds())
+		return conn, b, nil
+	}
+	return nil, nil, err
+}
+
+// candidates orders the backends by preference. Healthy backends come
+// first; unhealthy ones are still tried last rather than failing outright.
+func (p *Pool) candidates(client net.Addr) []*backend {
+	n := len(p.backends)
+	ordered := make([]*backend, n)
+	switch p.strategy {
+	case strategyRoundRobin:
+		start := int((atomic.AddUint32(&p.next, 1) - 1) % uint32(n))
+		for i := range ordered {
+			ordered[i] = p.backends[(start+i)%n]
+		}
+	case strategyLeastConn:
+		copy(ordered, p.backends)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomic.LoadInt64(&ordered[i].active) < atomic.LoadInt64(&ordered[j].active)
+		})
+	case strategyRandom:
+		for i, j := range rand.Perm(n) {
+			ordered[i] = p.backends[j]
+		}
+	case strategyHash:
+		// Rendezvous hashing: a client keeps its backend as long as that
+		// backend stays in the pool.
+		ip := client.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		weights := make(map[*backend]uint64, n)
+		for _, b := range p.backends {
+			h := fnv.New64a()
+			h.Write([]byte(ip))
+			h.Write([]byte(b.address))
+			weights[b] = h.Sum64()
+		}
+		copy(ordered, p.backends)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return weights[ordered[i]] > weights[ordered[j]]
+		})
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].healthy() && !ordered[j].healthy()
+	})
+	return ordered
+}
+
+// Start begins the health checks, if the pool has any.
+func (p *Pool) Start() {
+	if p.check == nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	for _, b := range p.backends {
+		up := 1.0
+		if !b.healthy() {
+			up = 0
+		}
+		backendUp.WithLabelValues(p.route, b.address).Set(up)
+		go p.watch(b)
+	}
+}
+
+// inherit takes over which backends the checks of an older pool of the same
+// route found down, so a reload does not send them clients until they pass
+// again.
+func (p *Pool) inherit(down map[[2]string]bool) {
+	if p.check == nil {
+		return
+	}
+	for _, b := range p.backends {
+		if down[[2]string{p.route, b.address}] {
+			atomic.StoreInt32(&b.down, 1)
+		}
+	}
+}
+
+// collectDown adds the backends the checks of p consider down to down,
+// keyed by route and address.
+func (p *Pool) collectDown(down map[[2]string]bool) {
+	for _, b := range p.backends {
+		if !b.healthy() {
+			down[[2]string{p.route, b.address}] = true
+		}
+	}
+}
+
+// Stop ends the health checks.
+func (p *Pool) Stop() {
+	if p.stop != nil {
+		p.stopOnce.Do(func() { close(p.stop) })
+	}
+}
+
+func (p *Pool) watch(b *backend) {
+	ticker := time.NewTicker(time.Duration(p.check.Interval) * time.Second)
+	defer ticker.Stop()
+	rises, falls := 0, 0
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		err := p.probe(b)
+		if err == nil {
+			rises, falls = rises+1, 0
+		} else {
+			rises, falls = 0, falls+1
+		}
+		switch {
+		case !b.healthy() && rises >= p.check.Rise:
+			atomic.StoreInt32(&b.down, 0)
+			backendUp.WithLabelValues(p.route, b.address).Set(1)
+			log.Warningf("Backend %s of route %s is up again.", b.address, p.route)
+		case b.healthy() && falls >= p.check.Fall:
+			atomic.StoreInt32(&b.down, 1)
+			backendUp.WithLabelValues(p.route, b.address).Set(0)
+			log.Warningf("Backend %s of route %s is down. %s", b.address, p.route, err)
+		}
+	}
+}
+
+func (p *Pool) probe(b *backend) error {
+	timeout := time.Duration(p.check.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", b.address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !p.check.TLS {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// Only liveness is checked here, the client verifies the certificate.
+	return tls.Client(conn, &tls.Config{ServerName: p.check.ServerName, InsecureSkipVerify: true}).Handshake()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testConfig(t *testing.T, backends ...string) *Config {
+	t.Helper()
+	c := &Config{}
+	c.Rules = Rules{{
+		Match:   matchExact,
+		Pattern: "a.com",
+		Route: Route{
+			Backends:    backends,
+			HealthCheck: &HealthCheck{Interval: 3600},
+		},
+	}}
+	if err := c.RuleSet.compile("", nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func backendGauges(t *testing.T) map[string]float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gauges := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "sni_gateway_backend_up" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "backend" {
+					gauges[label.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return gauges
+}
+
+func TestReloadKeepsBackendHealth(t *testing.T) {
+	old := testConfig(t, "10.0.0.1:443", "10.0.0.2:443")
+	old.Start()
+	defer old.Stop()
+	// Its checks found the second backend down.
+	old.pools()[0].backends[1].down = 1
+
+	c := testConfig(t, "10.0.0.2:443", "10.0.0.3:443")
+	c.inheritHealth(old)
+	c.Start()
+	defer c.Stop()
+	old.Stop()
+	c.forgetBackends(old)
+
+	for _, b := range c.pools()[0].backends {
+		if want := b.address != "10.0.0.2:443"; b.healthy() != want {
+			t.Errorf("%s healthy = %v, want %v", b.address, b.healthy(), want)
+		}
+	}
+	gauges := backendGauges(t)
+	want := map[string]float64{"10.0.0.2:443": 0, "10.0.0.3:443": 1}
+	for address, up := range want {
+		if got, ok := gauges[address]; !ok || got != up {
+			t.Errorf("backend_up of %s = %v (%v), want %v", address, got, ok, up)
+		}
+	}
+	if _, ok := gauges["10.0.0.1:443"]; ok {
+		t.Error("backend_up of the removed backend 10.0.0.1:443 is still exported")
+	}
+}
+
+func TestReloadKeepsHealthPerRoute(t *testing.T) {
+	old := testConfig(t, "10.0.0.1:443")
+	old.pools()[0].backends[0].down = 1
+
+	// b.com shares the backend but did not check it.
+	c := testConfig(t, "10.0.0.1:443")
+	c.Rules = append(c.Rules, Rule{
+		Match:   matchExact,
+		Pattern: "b.com",
+		Route: Route{
+			Backends:    []string{"10.0.0.1:443"},
+			HealthCheck: &HealthCheck{Interval: 3600},
+		},
+	})
+	if err := c.RuleSet.compile("", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.inheritHealth(old)
+	if c.GetRoute("a.com", nil).pool.backends[0].healthy() {
+		t.Error("a.com lost the health of its backend on reload")
+	}
+	if !c.GetRoute("b.com", nil).pool.backends[0].healthy() {
+		t.Error("b.com took over the health a.com found")
+	}
+}
+
+func TestPoolDialTimeout(t *testing.T) {
+	route := &Route{Backend: "10.0.0.1:443"}
+	p, err := NewPool(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.timeout != 2*time.Second {
+		t.Errorf("default timeout = %s", p.timeout)
+	}
+	route.DialTimeout = 5
+	if p, err = NewPool(route); err != nil {
+		t.Fatal(err)
+	}
+	if p.timeout != 5*time.Second {
+		t.Errorf("timeout = %s, want 5s", p.timeout)
+	}
+}
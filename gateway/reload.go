@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Reload loads the config file again and swaps it in if it is valid.
+// Connections already being handled keep the config they started with.
+func (s *SNIHandler) Reload() {
+	old := s.Config()
+	c, err := loadConfig(s.path, old)
+	if err != nil {
+		log.Warningf("Reload %s failed, keep the running config. %s", s.path, err.Error())
+		return
+	}
+	if !sameListeners(c.Listeners, old.Listeners) {
+		log.Warningf("Listeners changed, restart to apply them.")
+		// The running listeners stay, so c has to describe them.
+		c.Listeners = old.Listeners
+	}
+	certManager.SetHosts(c.acmeHosts())
+	c.inheritHealth(old)
+	c.Start()
+	s.config.Store(c)
+	old.Stop()
+	c.forgetBackends(old)
+	changes := c.Diff(old)
+	log.Warningf("Reloaded %s, %d route changes.", s.path, len(changes))
+	for _, change := range changes {
+		log.Warningf("Route %s", change)
+	}
+}
+
+func sameListeners(a, b []Listener) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WatchReload reloads the config on SIGHUP and, if Watch is set, whenever
+// the config file is written or replaced.
+func (s *SNIHandler) WatchReload() {
+	reload := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			trigger()
+		}
+	}()
+	if s.Config().Watch {
+		go s.watchFile(trigger)
+	}
+
+	for range reload {
+		s.Reload()
+	}
+}
+
+func (s *SNIHandler) watchFile(trigger func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warningf("Cannot watch config file. %s", err.Error())
+		return
+	}
+	defer watcher.Close()
+	// Watch the directory, editors often replace the file instead of
+	// writing to it.
+	path, _ := filepath.Abs(s.path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Warningf("Cannot watch config file. %s", err.Error())
+		return
+	}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(500 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warningf("Watch config file error. %s", err.Error())
+		case <-debounce:
+			debounce = nil
+			trigger()
+		}
+	}
+}
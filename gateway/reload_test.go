@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Catofes/SniGateway/certs"
+)
+
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHandler serves the config at path as if started with it.
+func testHandler(t *testing.T, path string) *SNIHandler {
+	t.Helper()
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certManager, err = certs.NewManager(certs.Config{CacheDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	s := &SNIHandler{path: path}
+	c.Start()
+	s.config.Store(c)
+	t.Cleanup(func() { s.Config().Stop() })
+	return s
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{
+		"ListenAddress": "127.0.0.1", "ListenPort": 8443,
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.1:443"}]
+	}`)
+	s := testHandler(t, path)
+	running := s.Config()
+
+	// A config that does not load keeps the running one.
+	writeConfig(t, path, `{"Rules": [{"Match": "regex", "Pattern": "(", "Backend": "10.0.0.2:443"}]}`)
+	s.Reload()
+	if s.Config() != running {
+		t.Fatal("invalid config replaced the running one")
+	}
+	writeConfig(t, path, `{"Listeners": [{"Address": "127.0.0.1", "Port": 8443, "RuleSet": "none"}]}`)
+	s.Reload()
+	if s.Config() != running {
+		t.Fatal("config with an unknown rule set replaced the running one")
+	}
+
+	// Routes change, the listeners stay.
+	writeConfig(t, path, `{
+		"ListenAddress": "127.0.0.1", "ListenPort": 9443,
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.2:443"},
+			{"Match": "suffix", "Pattern": "b.com", "Backend": "10.0.0.3:443"}]
+	}`)
+	s.Reload()
+	c := s.Config()
+	if c == running {
+		t.Fatal("valid config not applied")
+	}
+	if got := c.GetRoute("a.com", nil).Backend; got != "10.0.0.2:443" {
+		t.Errorf("a.com routed to %s after reload", got)
+	}
+	if !reflect.DeepEqual(c.Listeners, running.Listeners) {
+		t.Errorf("listeners %v after reload, want %v", c.Listeners, running.Listeners)
+	}
+	if changes := c.Diff(running); len(changes) != 2 {
+		t.Errorf("changes %q, want a changed and an added route", changes)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	dir := t.TempDir()
+	load := func(config string) *Config {
+		path := filepath.Join(dir, "config.json")
+		writeConfig(t, path, config)
+		c, err := LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	old := load(`{
+		"Default": "10.0.0.9:443",
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.1:443"},
+			{"Match": "exact", "Pattern": "b.com", "Backend": "10.0.0.2:443"}],
+		"RuleSets": {"x": {"Default": "reject"}}
+	}`)
+	c := load(`{
+		"Rules": [{"Match": "exact", "Pattern": "a.com", "Backend": "10.0.0.5:443"},
+			{"Match": "exact", "Pattern": "c.com", "Backend": "10.0.0.3:443"}],
+		"RuleSets": {"x": {"Default": "reject"}, "y": {"NoSNI": "10.0.0.4:443"}}
+	}`)
+	got := c.Diff(old)
+	want := []string{
+		"removed exact b.com -> 10.0.0.2:443",
+		"removed default -> 10.0.0.9:443",
+		"changed exact a.com -> 10.0.0.5:443 (was 10.0.0.1:443)",
+		"added exact c.com -> 10.0.0.3:443",
+		"y: added no SNI -> 10.0.0.4:443",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %q\nwant %q", got, want)
+	}
+	if changes := c.Diff(c); len(changes) != 0 {
+		t.Errorf("config differs from itself: %q", changes)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Catofes/SniGateway/certs"
+)
+
+const (
+	matchExact    = "exact"
+	matchWildcard = "wildcard"
+	matchSuffix   = "suffix"
+	matchRegex    = "regex"
+
+	alpnAny = "any"
+	alpnAll = "all"
+)
+
+// Rule maps SNI host names to a backend. Match selects how Pattern is
+// interpreted:
+//
+//	exact     a.example.com   only that host
+//	wildcard  *.example.com   exactly one label in front of example.com
+//	suffix    example.com     example.com and every name below it
+//	regex     ^a+\.com$       anchored regular expression
+//
+// A rule with ALPN set also requires the ClientHello to offer any, or with
+// ALPNMatch "all" every, protocol in it. Such a rule may leave Match and
+// Pattern empty to match every host.
+type Rule struct {
+	Name      string
+	Match     string
+	Pattern   string
+	ALPN      []string
+	ALPNMatch string
+	Route
+}
+
+// matchALPN reports whether the offered protocols satisfy the rule.
+func (r *Rule) matchALPN(offered []string) bool {
+	if len(r.ALPN) == 0 {
+		return true
+	}
+	found := 0
+	for _, want := range r.ALPN {
+		for _, p := range offered {
+			if p == want {
+				found++
+				break
+			}
+		}
+	}
+	if r.ALPNMatch == alpnAll {
+		return found == len(r.ALPN)
+	}
+	return found > 0
+}
+
+// key identifies the rule in reload diffs.
+func (r *Rule) key() string {
+	if r.Match == "" {
+		return "alpn " + r.alpnString()
+	}
+	key := r.Match + " " + r.Pattern
+	if len(r.ALPN) > 0 {
+		key += " alpn " + r.alpnString()
+	}
+	return key
+}
+
+func (r *Rule) alpnString() string {
+	match := r.ALPNMatch
+	if match == "" {
+		match = alpnAny
+	}
+	return match + ":" + strings.Join(r.ALPN, ",")
+}
+
+// Route is where a matched connection is sent: Backend, or a pool of
+// Backends balanced by Strategy.
+type Route struct {
+	Backend     string
+	Backends    []string
+	Strategy    string
+	HealthCheck *HealthCheck
+	// DialTimeout bounds connecting to a backend for a client, in seconds,
+	// 2 if unset.
+	DialTimeout int
+	// ProxyProtocol prepends a PROXY protocol header of this version, 1 or
+	// 2, to the stream sent to the backend. Version 2 also carries the SNI.
+	ProxyProtocol int
+	// Terminate, if set, ends TLS in the gateway instead of passing it
+	// through.
+	Terminate *Terminate
+	// MaxConnections caps the connections forwarded by the route at once,
+	// unlimited if zero.
+	MaxConnections int
+	// Access restricts the clients of the route further than the
+	// Config.Access of all routes.
+	Access *Access
+	// name is the route's name within its rule set. label prefixes it with
+	// the rule set's name, to tell it apart from routes of the same name in
+	// other rule sets in metrics and for MaxConnections.
+	name       string
+	label      string
+	pool       *Pool
+	serverTLS  *tls.Config
+	backendTLS *tls.Config
+	certs      *certs.Store
+	acl        *acl
+}
+
+func (r *Route) empty() bool {
+	return r.Backend == "" && len(r.Backends) == 0
+}
+
+func (r *Route) validate() error {
+	if r.empty() {
+		return fmt.Errorf("no backend")
+	}
+	if r.ProxyProtocol < 0 || r.ProxyProtocol > 2 {
+		return fmt.Errorf("invalid PROXY protocol version %d", r.ProxyProtocol)
+	}
+	if r.MaxConnections < 0 {
+		return fmt.Errorf("invalid MaxConnections %d", r.MaxConnections)
+	}
+	if r.Terminate != nil {
+		return r.Terminate.validate()
+	}
+	return nil
+}
+
+// prepare builds the backend pool and TLS configs of the route.
+func (r *Route) prepare() error {
+	if r.empty() || r.Backend == backendReject {
+		return nil
+	}
+	if r.Terminate != nil {
+		if err := r.prepareTLS(); err != nil {
+			return err
+		}
+	}
+	var err error
+	r.pool, err = NewPool(r)
+	return err
+}
+
+func (r Route) String() string {
+	backends := r.Backend
+	if len(r.Backends) > 0 {
+		backends = strings.Join(append([]string{r.Backend}, r.Backends...), ",")
+		backends = strings.TrimPrefix(backends, ",")
+		if r.Strategy != "" {
+			backends += " " + r.Strategy
+		}
+	}
+	if r.Terminate != nil {
+		if r.Terminate.BackendTLS != nil {
+			backends += " (terminate, re-encrypt)"
+		} else {
+			backends += " (terminate)"
+		}
+	}
+	if r.Access != nil {
+		backends += " (restricted)"
+	}
+	if r.ProxyProtocol != 0 {
+		return fmt.Sprintf("%s (PROXY v%d)", backends, r.ProxyProtocol)
+	}
+	return backends
+}
+
+// Rules accepts both the rule objects above and the legacy
+// {"pattern": "backend"} maps, which become anchored regex rules.
+type Rules []Rule
+
+func (r *Rules) UnmarshalJSON(data []byte) error {
+	var raws []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+	*r = nil
+	for _, raw := range raws {
+		if isRuleObject(raw) {
+			var rule Rule
+			if err := json.Unmarshal(encode(raw), &rule); err != nil {
+				return err
+			}
+			*r = append(*r, rule)
+			continue
+		}
+		keys := make([]string, 0, len(raw))
+		for k := range raw {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var backend string
+			if err := json.Unmarshal(raw[k], &backend); err != nil {
+				return fmt.Errorf("rule %q: %s", k, err)
+			}
+			*r = append(*r, Rule{Match: matchRegex, Pattern: k, Route: Route{Backend: backend}})
+		}
+	}
+	return nil
+}
+
+func isRuleObject(raw map[string]json.RawMessage) bool {
+	for k := range raw {
+		switch strings.ToLower(k) {
+		case "match", "pattern", "alpn", "backend", "backends", "proxyprotocol", "terminate", "access":
+			return true
+		}
+	}
+	return false
+}
+
+func encode(raw map[string]json.RawMessage) []byte {
+	data, _ := json.Marshal(raw)
+	return data
+}
+
+// Router is a routing table compiled from Rules. Exact and wildcard rules
+// are found with a map lookup and suffix rules with a trie walk, so only
+// regex rules are tried one by one. The first matching rule in
+// configuration order wins.
+type Router struct {
+	rules    []Rule
+	exact    map[string][]int
+	wildcard map[string][]int
+	suffix   *suffixNode
+	regex    []compiledRegex
+	// any holds the rules matching every host by ALPN alone.
+	any []int
+}
+
+type compiledRegex struct {
+	index int
+	re    *regexp.Regexp
+}
+
+type suffixNode struct {
+	children map[string]*suffixNode
+	rules    []int
+}
+
+func NewRouter(rules []Rule) (*Router, error) {
+	r := &Router{
+		rules:    rules,
+		exact:    make(map[string][]int),
+		wildcard: make(map[string][]int),
+		suffix:   &suffixNode{},
+	}
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %s", i, rule.Pattern, err)
+		}
+		switch rule.ALPNMatch {
+		case "", alpnAny, alpnAll:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown ALPN match %q", i, rule.ALPNMatch)
+		}
+		switch {
+		case rule.Name != "":
+			r.rules[i].name = rule.Name
+		case rule.Match == "":
+			r.rules[i].name = "alpn:" + rule.alpnString()
+		case len(rule.ALPN) > 0:
+			r.rules[i].name = rule.Match + ":" + rule.Pattern + "+alpn:" + rule.alpnString()
+		default:
+			r.rules[i].name = rule.Match + ":" + rule.Pattern
+		}
+		pattern := normalizeHost(rule.Pattern)
+		switch rule.Match {
+		case "":
+			if len(rule.ALPN) == 0 || rule.Pattern != "" {
+				return nil, fmt.Errorf("rule %d: no match type", i)
+			}
+			r.any = append(r.any, i)
+		case matchExact:
+			if pattern == "" || strings.Contains(pattern, "*") {
+				return nil, fmt.Errorf("rule %d: invalid exact host %q", i, rule.Pattern)
+			}
+			r.exact[pattern] = append(r.exact[pattern], i)
+		case matchWildcard:
+			parent := strings.TrimPrefix(pattern, "*.")
+			if parent == pattern || parent == "" || strings.Contains(parent, "*") {
+				return nil, fmt.Errorf("rule %d: invalid wildcard %q, want *.example.com", i, rule.Pattern)
+			}
+			r.wildcard[parent] = append(r.wildcard[parent], i)
+		case matchSuffix:
+			pattern = strings.TrimPrefix(pattern, ".")
+			if pattern == "" || strings.Contains(pattern, "*") {
+				return nil, fmt.Errorf("rule %d: invalid suffix %q", i, rule.Pattern)
+			}
+			r.suffix.insert(pattern, i)
+		case matchRegex:
+			// Hosts are looked up in lower case, so patterns written with
+			// upper case letters must still match them.
+			re, err := regexp.Compile("(?i)^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid regex %q: %s", i, rule.Pattern, err)
+			}
+			r.regex = append(r.regex, compiledRegex{i, re})
+		default:
+			return nil, fmt.Errorf("rule %d: unknown match type %q", i, rule.Match)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the first rule matching host and the offered ALPN
+// protocols, or nil.
+func (r *Router) Lookup(host string, alpn []string) *Rule {
+	host = normalizeHost(host)
+	best := -1
+	// Candidates are in rule order, so the first one accepting the ALPN
+	// protocols is the best of the list.
+	better := func(candidates []int) {
+		for _, i := range candidates {
+			if best >= 0 && i > best {
+				return
+			}
+			if r.rules[i].matchALPN(alpn) {
+				best = i
+				return
+			}
+		}
+	}
+	better(r.exact[host])
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		better(r.wildcard[host[i+1:]])
+	}
+	r.suffix.walk(host, better)
+	better(r.any)
+	for _, c := range r.regex {
+		if best >= 0 && c.index > best {
+			break
+		}
+		if r.rules[c.index].matchALPN(alpn) && c.re.MatchString(host) {
+			best = c.index
+			break
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return &r.rules[best]
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (n *suffixNode) insert(suffix string, index int) {
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*suffixNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &suffixNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.rules = append(n.rules, index)
+}
+
+// walk calls fn with the rules of every suffix of host, label by label.
+func (n *suffixNode) walk(host string, fn func([]int)) {
+	for host != "" {
+		i := strings.LastIndexByte(host, '.')
+		n = n.children[host[i+1:]]
+		if n == nil {
+			return
+		}
+		fn(n.rules)
+		if i < 0 {
+			return
+		}
+		host = host[:i]
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRouterLookup(t *testing.T) {
+	rules := []Rule{
+		{Match: matchExact, Pattern: "A.example.com", Route: Route{Backend: "exact"}},
+		{Match: matchWildcard, Pattern: "*.example.com", Route: Route{Backend: "wildcard"}},
+		{Match: matchSuffix, Pattern: "example.com", Route: Route{Backend: "suffix"}},
+		{Match: matchRegex, Pattern: `API[0-9]+\.example\.org`, Route: Route{Backend: "regex"}},
+		{Match: matchSuffix, Pattern: ".example.org", Route: Route{Backend: "suffix-org"}},
+		// Shadowed by the wildcard above.
+		{Match: matchExact, Pattern: "late.example.com", Route: Route{Backend: "late"}},
+		{ALPN: []string{"x-tun"}, Route: Route{Backend: "alpn-only"}},
+		{Match: matchExact, Pattern: "h2.example.net", ALPN: []string{"h2"}, Route: Route{Backend: "h2"}},
+		{Match: matchExact, Pattern: "both.example.net", ALPN: []string{"h2", "x-tun"}, ALPNMatch: alpnAll, Route: Route{Backend: "both"}},
+		{Match: matchSuffix, Pattern: "example.net", Route: Route{Backend: "suffix-net"}},
+	}
+	r, err := NewRouter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		alpn []string
+		want string
+	}{
+		{"a.example.com", nil, "exact"},
+		{"A.EXAMPLE.COM.", nil, "exact"},
+		{"b.example.com", nil, "wildcard"},
+		{"late.example.com", nil, "wildcard"},
+		{"example.com", nil, "suffix"},
+		{"x.b.example.com", nil, "suffix"},
+		{"xexample.com", nil, ""},
+		{"api12.example.org", nil, "regex"},
+		{"Api12.Example.ORG", nil, "regex"},
+		{"api.example.org", nil, "suffix-org"},
+		{"a.api12.example.org", nil, "suffix-org"},
+		{"other.test", nil, ""},
+		{"other.test", []string{"h2", "x-tun"}, "alpn-only"},
+		{"a.example.com", []string{"x-tun"}, "exact"},
+		{"h2.example.net", []string{"http/1.1", "h2"}, "h2"},
+		{"h2.example.net", []string{"http/1.1"}, "suffix-net"},
+		{"both.example.net", []string{"h2"}, "suffix-net"},
+		{"both.example.net", []string{"x-tun", "h2"}, "alpn-only"},
+		{"", nil, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if rule := r.Lookup(test.host, test.alpn); rule != nil {
+			got = rule.Backend
+		}
+		if got != test.want {
+			t.Errorf("Lookup(%q, %q) = %q, want %q", test.host, test.alpn, got, test.want)
+		}
+	}
+}
+
+func TestRouterLegacyRules(t *testing.T) {
+	var rules Rules
+	config := `[{"Example\\.com": "legacy:443", "(www|API)\\.b\\.com": "b:443"},
+		{"Match": "exact", "Pattern": "c.com", "Backend": "c:443"}]`
+	if err := json.Unmarshal([]byte(config), &rules); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"example.com":  "legacy:443",
+		"EXAMPLE.com":  "legacy:443",
+		"xexample.com": "",
+		"api.b.com":    "b:443",
+		"www.b.com":    "b:443",
+		"c.com":        "c:443",
+	} {
+		got := ""
+		if rule := r.Lookup(host, nil); rule != nil {
+			got = rule.Backend
+		}
+		if got != want {
+			t.Errorf("Lookup(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestRouterInvalid(t *testing.T) {
+	for _, rule := range []Rule{
+		{Match: matchExact, Pattern: "*.a.com", Route: Route{Backend: "b"}},
+		{Match: matchWildcard, Pattern: "a.com", Route: Route{Backend: "b"}},
+		{Match: matchWildcard, Pattern: "*.*.a.com", Route: Route{Backend: "b"}},
+		{Match: matchSuffix, Pattern: ".", Route: Route{Backend: "b"}},
+		{Match: matchRegex, Pattern: "(", Route: Route{Backend: "b"}},
+		{Match: "glob", Pattern: "a.com", Route: Route{Backend: "b"}},
+		{Match: matchExact, Pattern: "a.com"},
+		{Pattern: "a.com", Route: Route{Backend: "b"}},
+		{ALPN: []string{"h2"}, ALPNMatch: "most", Route: Route{Backend: "b"}},
+	} {
+		if _, err := NewRouter([]Rule{rule}); err == nil {
+			t.Errorf("NewRouter accepted %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/Catofes/SniGateway/certs"
+	"github.com/Catofes/SniGateway/internal/prefixconn"
+)
+
+// Terminate makes the gateway complete the TLS handshake of a route itself
+// and forward the decrypted stream to the backend.
+type Terminate struct {
+	// Cert and Key are the certificate to present, reloaded when the files
+	// change. Without them the certificates configured in
+	// Config.Certificates are used, and ACME certificates are obtained for
+	// Hosts, or for the pattern of an exact rule when Hosts is empty.
+	Cert  string
+	Key   string
+	Hosts []string
+	// ALPN lists the protocols to negotiate with clients, none by default.
+	ALPN []string
+	// BackendTLS re-encrypts the stream to the backend.
+	BackendTLS *BackendTLS
+}
+
+// BackendTLS is how a terminating route connects to its backend over TLS.
+type BackendTLS struct {
+	// ServerName defaults to the SNI of the client. The NoSNI route needs
+	// it unless Insecure is set.
+	ServerName string
+	// CA is a file of PEM certificates to verify the backend with instead
+	// of the system roots. Insecure skips verification.
+	CA       string
+	Insecure bool
+}
+
+// certManager serves the terminating routes without a certificate of their
+// own. It is made from the startup config and kept across reloads, which
+// only update its ACME hosts.
+var certManager *certs.Manager
+
+func (t *Terminate) validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("terminate needs both Cert and Key")
+	}
+	return nil
+}
+
+// prepareTLS builds the TLS configs for clients and, if re-encrypting, for
+// the backend.
+func (r *Route) prepareTLS() error {
+	t := r.Terminate
+	if t.Cert != "" {
+		store, err := certs.NewStore([]certs.Pair{{Cert: t.Cert, Key: t.Key}})
+		if err != nil {
+			return err
+		}
+		r.certs = store
+		r.serverTLS = &tls.Config{GetCertificate: store.GetCertificate, NextProtos: t.ALPN}
+	} else {
+		r.serverTLS = certs.ServeChallenges(&tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return certManager.GetCertificate(hello)
+			},
+			NextProtos: t.ALPN,
+		})
+	}
+	if t.BackendTLS == nil {
+		return nil
+	}
+	r.backendTLS = &tls.Config{
+		ServerName:         t.BackendTLS.ServerName,
+		InsecureSkipVerify: t.BackendTLS.Insecure,
+	}
+	if t.BackendTLS.CA != "" {
+		data, err := ioutil.ReadFile(t.BackendTLS.CA)
+		if err != nil {
+			return err
+		}
+		r.backendTLS.RootCAs = x509.NewCertPool()
+		if !r.backendTLS.RootCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", t.BackendTLS.CA)
+		}
+	}
+	return nil
+}
+
+// acmeHosts lists the names the terminating routes may get ACME
+// certificates for.
+func (c *Config) acmeHosts() []string {
+	hosts := append([]string{}, c.Certificates.Hosts...)
+	for _, set := range c.ruleSets() {
+		for _, rule := range set.Rules {
+			t := rule.Terminate
+			switch {
+			case t == nil || t.Cert != "":
+			case len(t.Hosts) > 0:
+				hosts = append(hosts, t.Hosts...)
+			case rule.Match == matchExact:
+				hosts = append(hosts, rule.Pattern)
+			}
+		}
+		// The fallbacks have no pattern to take a name from.
+		for _, f := range []*Fallback{&set.Default, &set.NoSNI} {
+			if t := f.Terminate; t != nil && t.Cert == "" {
+				hosts = append(hosts, t.Hosts...)
+			}
+		}
+	}
+	return hosts
+}
+
+// terminate completes the handshake of lc, whose ClientHello hello was
+// already read, within timeout.
+func (r *Route) terminate(lc net.Conn, hello []byte, timeout time.Duration) (*tls.Conn, error) {
+	conn := tls.Server(&prefixconn.Conn{Conn: lc, Prefix: hello}, r.serverTLS)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// encrypt starts TLS with the backend on rc, defaulting the server name to
+// sni.
+func (r *Route) encrypt(rc net.Conn, sni string) (*tls.Conn, error) {
+	config := r.backendTLS
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = sni
+	}
+	conn := tls.Client(rc, config)
+	conn.SetDeadline(time.Now().Add(r.pool.timeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestACMEHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{
+		"Certificates": {"Hosts": ["shared.example.com"]},
+		"Rules": [
+			{"Match": "exact", "Pattern": "a.example.com", "Backend": "10.0.0.1:80", "Terminate": {}},
+			{"Match": "suffix", "Pattern": "example.net", "Backend": "10.0.0.2:80", "Terminate": {"Hosts": ["www.example.net"]}},
+			{"Match": "suffix", "Pattern": "example.org", "Backend": "10.0.0.3:80", "Terminate": {}},
+			{"Match": "exact", "Pattern": "plain.example.com", "Backend": "10.0.0.4:443"}
+		],
+		"Default": {"Backend": "10.0.0.5:80", "Terminate": {"Hosts": ["default.example.com"]}},
+		"RuleSets": {"other": {
+			"NoSNI": {"Backend": "10.0.0.6:80", "Terminate": {"Hosts": ["nosni.example.com"]}}
+		}}
+	}`)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := c.acmeHosts()
+	sort.Strings(hosts)
+	want := []string{"a.example.com", "default.example.com", "nosni.example.com", "shared.example.com", "www.example.net"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("hosts %q, want %q", hosts, want)
+	}
+}
+
+func TestNoSNIBackendTLS(t *testing.T) {
+	tests := []struct {
+		backendTLS string
+		fail       bool
+	}{
+		{`{}`, true},
+		{`{"ServerName": "backend.example.com"}`, false},
+		{`{"Insecure": true}`, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		writeConfig(t, path, `{
+			"NoSNI": {"Backend": "10.0.0.1:443", "Terminate": {"BackendTLS": `+test.backendTLS+`}},
+			"Default": {"Backend": "10.0.0.2:443", "Terminate": {"BackendTLS": {}}}
+		}`)
+		_, err := LoadConfig(path)
+		switch {
+		case test.fail && err == nil:
+			t.Errorf("BackendTLS %s of NoSNI accepted", test.backendTLS)
+		case !test.fail && err != nil:
+			t.Errorf("BackendTLS %s of NoSNI: %s", test.backendTLS, err)
+		case err != nil && !strings.Contains(err.Error(), "ServerName"):
+			t.Errorf("BackendTLS %s of NoSNI: unexpected error %s", test.backendTLS, err)
+		}
+	}
+}
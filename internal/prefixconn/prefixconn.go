@@ -0,0 +1,38 @@
+// Package prefixconn puts bytes already read from a connection back in
+// front of it.
+package prefixconn
+
+import (
+	"net"
+)
+
+// Conn returns Prefix from Read before reading from Conn again, such as
+// bytes a protocol handshake read past its end. It passes CloseRead and
+// CloseWrite on to Conn, so piping still half-closes.
+type Conn struct {
+	net.Conn
+	Prefix []byte
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.Prefix) > 0 {
+		n := copy(b, c.Prefix)
+		c.Prefix = c.Prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package prefixconn
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		b.Write([]byte(" world"))
+		b.Close()
+	}()
+	data, err := ioutil.ReadAll(&Conn{Conn: a, Prefix: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "hello world" {
+		t.Errorf("read %q", got)
+	}
+}
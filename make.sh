@@ -9,6 +9,9 @@ function try () {
 DIR=$(pwd)
 MIN_API=$1
 DEPS=$(pwd)/.deps
+# MIN_GO is the oldest Go the code builds with, which the fork in go must
+# be based on.
+MIN_GO=1.24
 ANDROID_ARM_TOOLCHAIN=$DEPS/toolchains/arm-$1
 ANDROID_X86_TOOLCHAIN=$DEPS/toolchains/x86_64-$1
 
@@ -43,6 +46,12 @@ export GOROOT=$DIR/go
 export GOPATH=/home/herbertqiao/Documents/gocode
 export PATH=$GOROOT/bin:$PATH
 
+GO_VERSION=$(go version | sed -n 's/^go version go\([0-9.]*\).*/\1/p')
+if [ "$(printf '%s\n%s\n' "$MIN_GO" "$GO_VERSION" | sort -V | head -n 1)" != "$MIN_GO" ]; then
+    echo "The go submodule is go$GO_VERSION, update it to go$MIN_GO or newer"
+    exit -1
+fi
+
 #mkdir -p build/arm
 #mkdir -p build/x86
 
@@ -0,0 +1,42 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/Catofes/SniGateway/internal/prefixconn"
+)
+
+// Conn is a connection whose PROXY protocol header has been consumed. Its
+// RemoteAddr and LocalAddr report the addresses from the header.
+type Conn struct {
+	*prefixconn.Conn
+	header *ParsedHeader
+}
+
+// NewConn reads the PROXY protocol header at the start of c. The header is
+// mandatory: a connection without one yields ErrNoHeader.
+func NewConn(c net.Conn) (*Conn, error) {
+	r := bufio.NewReader(c)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// The stream read along with the header is returned first.
+	buffered, _ := r.Peek(r.Buffered())
+	return &Conn{Conn: &prefixconn.Conn{Conn: c, Prefix: buffered}, header: header}, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,217 @@
+// Package proxyproto writes and reads HAProxy PROXY protocol v1 and v2
+// headers, which carry the original client address over a proxied TCP
+// connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TypeAuthority is the v2 TLV carrying the host name the client asked
+	// for, i.e. the SNI.
+	TypeAuthority uint8 = 0x02
+
+	v1MaxLength = 107
+)
+
+var (
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoHeader  = errors.New("proxyproto: no PROXY protocol header")
+	ErrMalformed = errors.New("proxyproto: malformed header")
+)
+
+// TLV is a v2 type-length-value extension.
+type TLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// Header encodes a PROXY protocol header of the given version for a
+// connection from src to dst. TLVs are only sent with version 2.
+func Header(version int, src, dst net.Addr, tlvs ...TLV) ([]byte, error) {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	v4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)), nil
+	case 2:
+		var addrs []byte
+		family := byte(0x00)
+		switch {
+		case v4:
+			family = 0x11
+			addrs = append(addrs, srcTCP.IP.To4()...)
+			addrs = append(addrs, dstTCP.IP.To4()...)
+		case known:
+			family = 0x21
+			addrs = append(addrs, srcTCP.IP.To16()...)
+			addrs = append(addrs, dstTCP.IP.To16()...)
+		}
+		if known {
+			addrs = append(addrs, byte(srcTCP.Port>>8), byte(srcTCP.Port))
+			addrs = append(addrs, byte(dstTCP.Port>>8), byte(dstTCP.Port))
+		}
+		for _, tlv := range tlvs {
+			if len(tlv.Value) > 0xffff {
+				return nil, ErrMalformed
+			}
+			addrs = append(addrs, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+			addrs = append(addrs, tlv.Value...)
+		}
+		if len(addrs) > 0xffff {
+			return nil, ErrMalformed
+		}
+		header := append([]byte{}, v2Signature...)
+		// Version 2, PROXY command.
+		header = append(header, 0x21, family, byte(len(addrs)>>8), byte(len(addrs)))
+		return append(header, addrs...), nil
+	}
+	return nil, fmt.Errorf("proxyproto: unsupported version %d", version)
+}
+
+// ParsedHeader is a parsed PROXY protocol header. Source and Destination are nil
+// for v1 UNKNOWN and v2 LOCAL headers.
+type ParsedHeader struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []TLV
+}
+
+// ReadHeader reads a v1 or v2 header from r. ErrNoHeader is returned,
+// without consuming anything, if r does not start with one.
+func ReadHeader(r *bufio.Reader) (*ParsedHeader, error) {
+	if b, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+	if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+		return readV1(r)
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*ParsedHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, ErrMalformed
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrMalformed
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ParsedHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrMalformed
+	}
+	var err error
+	if h.Source, err = parseV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrMalformed
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*ParsedHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrMalformed
+	}
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ParsedHeader{Version: 2}
+	if command == 0x00 {
+		// LOCAL: the proxy talks for itself, e.g. a health check.
+		return h, nil
+	}
+	if command != 0x01 {
+		return nil, ErrMalformed
+	}
+	var ipLen int
+	switch family {
+	case 0x11:
+		ipLen = 4
+	case 0x21:
+		ipLen = 16
+	default:
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, ErrMalformed
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	rest := body[2*ipLen+4:]
+	for len(rest) > 0 {
+		if len(rest) < 3 {
+			return nil, ErrMalformed
+		}
+		length := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+length {
+			return nil, ErrMalformed
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: rest[0], Value: rest[3 : 3+length]})
+		rest = rest[3+length:]
+	}
+	return h, nil
+}
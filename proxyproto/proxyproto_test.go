@@ -0,0 +1,177 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var v2Sig = "0d0a0d0a000d0a515549540a"
+
+// sameHeader compares a and b, taking the 4 and 16 byte forms of an IPv4
+// address as equal.
+func sameHeader(a, b *ParsedHeader) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	sameAddr := func(x, y *net.TCPAddr) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		return x.IP.Equal(y.IP) && x.Port == y.Port
+	}
+	return a.Version == b.Version && sameAddr(a.Source, b.Source) &&
+		sameAddr(a.Destination, b.Destination) && reflect.DeepEqual(a.TLVs, b.TLVs)
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		header *ParsedHeader
+		err    error
+	}{
+		{
+			"v1 TCP4",
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			&ParsedHeader{Version: 1, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("198.51.100.2:443")},
+			nil,
+		},
+		{
+			"v1 TCP6",
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			&ParsedHeader{Version: 1, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")},
+			nil,
+		},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), &ParsedHeader{Version: 1}, nil},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), &ParsedHeader{Version: 1}, nil},
+		{
+			"v2 PROXY TCP4",
+			mustHex(v2Sig + "21 11 000c c0000201 c6336402 dc04 01bb"),
+			&ParsedHeader{Version: 2, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("198.51.100.2:443")},
+			nil,
+		},
+		{
+			"v2 PROXY TCP6",
+			mustHex(v2Sig + "21 21 0024 20010db8000000000000000000000001 20010db8000000000000000000000002 dc04 01bb"),
+			&ParsedHeader{Version: 2, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")},
+			nil,
+		},
+		{"v2 LOCAL", mustHex(v2Sig + "20 00 0000"), &ParsedHeader{Version: 2}, nil},
+		{
+			"v2 authority TLV",
+			mustHex(v2Sig + "21 11 001a c0000201 c6336402 dc04 01bb 02 000b 6578616d706c652e636f6d"),
+			&ParsedHeader{
+				Version:     2,
+				Source:      tcpAddr("192.0.2.1:56324"),
+				Destination: tcpAddr("198.51.100.2:443"),
+				TLVs:        []TLV{{Type: TypeAuthority, Value: []byte("example.com")}},
+			},
+			nil,
+		},
+		{"no header", []byte("\x16\x03\x01\x00\x05hello"), nil, ErrNoHeader},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51.100.2"), nil, io.EOF},
+		{"v1 oversized", []byte("PROXY TCP6 " + strings.Repeat("1", 120) + "\r\n"), nil, ErrMalformed},
+		{"v1 without CR", []byte("PROXY UNKNOWN\n"), nil, ErrMalformed},
+		{"v1 bad family", []byte("PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n"), nil, ErrMalformed},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2.300 198.51.100.2 1 2\r\n"), nil, ErrMalformed},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1 65536\r\n"), nil, ErrMalformed},
+		{"v2 bad signature", mustHex("0d0a0d0a000d0a515549540b 21 11 000c c0000201 c6336402 dc04 01bb"), nil, ErrNoHeader},
+		{"v2 bad version", mustHex(v2Sig + "11 11 000c c0000201 c6336402 dc04 01bb"), nil, ErrMalformed},
+		{"v2 bad command", mustHex(v2Sig + "22 11 000c c0000201 c6336402 dc04 01bb"), nil, ErrMalformed},
+		{"v2 length too short", mustHex(v2Sig + "21 11 0008 c0000201 c6336402"), nil, ErrMalformed},
+		{"v2 length past end", mustHex(v2Sig + "21 11 0010 c0000201 c6336402 dc04 01bb"), nil, io.ErrUnexpectedEOF},
+		{"v2 truncated TLV", mustHex(v2Sig + "21 11 0011 c0000201 c6336402 dc04 01bb 02 0005 61"), nil, ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The stream after the header has to be left unread. Truncated
+			// headers are not followed by anything.
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(test.input), strings.NewReader("rest")))
+			if test.err == io.EOF || test.err == io.ErrUnexpectedEOF {
+				r = bufio.NewReader(bytes.NewReader(test.input))
+			}
+			header, err := ReadHeader(r)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if !sameHeader(header, test.header) {
+				t.Errorf("header %+v, want %+v", header, test.header)
+			}
+			if err != nil {
+				return
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "rest" {
+				t.Errorf("left %q after the header", rest)
+			}
+		})
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tlvs := []TLV{{Type: TypeAuthority, Value: []byte("example.com")}}
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+		tlvs     []TLV
+		want     *ParsedHeader
+	}{
+		{1, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.2:443"), nil,
+			&ParsedHeader{Version: 1, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("198.51.100.2:443")}},
+		{1, tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:443"), nil,
+			&ParsedHeader{Version: 1, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		{1, &net.UnixAddr{Name: "a", Net: "unix"}, tcpAddr("198.51.100.2:443"), nil, &ParsedHeader{Version: 1}},
+		// TLVs are dropped with version 1.
+		{1, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.2:443"), tlvs,
+			&ParsedHeader{Version: 1, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("198.51.100.2:443")}},
+		{2, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.2:443"), tlvs,
+			&ParsedHeader{Version: 2, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("198.51.100.2:443"), TLVs: tlvs}},
+		{2, tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:443"), nil,
+			&ParsedHeader{Version: 2, Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		// A v4 client on a v6 listener is sent as TCP6.
+		{2, tcpAddr("192.0.2.1:56324"), tcpAddr("[2001:db8::2]:443"), nil,
+			&ParsedHeader{Version: 2, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("[2001:db8::2]:443")}},
+	}
+	for _, test := range tests {
+		header, err := Header(test.version, test.src, test.dst, test.tlvs...)
+		if err != nil {
+			t.Fatalf("Header(%d, %v, %v): %s", test.version, test.src, test.dst, err)
+		}
+		got, err := ReadHeader(bufio.NewReader(bytes.NewReader(header)))
+		if err != nil {
+			t.Fatalf("ReadHeader(%q): %s", header, err)
+		}
+		if !sameHeader(got, test.want) {
+			t.Errorf("Header(%d, %v, %v) read back as %+v, want %+v", test.version, test.src, test.dst, got, test.want)
+		}
+	}
+	if _, err := Header(3, tcpAddr("192.0.2.1:1"), tcpAddr("192.0.2.2:2")); err == nil {
+		t.Error("Header accepted version 3")
+	}
+	if _, err := Header(2, tcpAddr("192.0.2.1:1"), tcpAddr("192.0.2.2:2"), TLV{Value: make([]byte, 0x10000)}); err != ErrMalformed {
+		t.Errorf("oversized TLV: error %v, want %v", err, ErrMalformed)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenTimeout is how long a client has to send its token before it is
+// treated as a prober.
+var tokenTimeout = 10 * time.Second
+
+// newFallback returns the handler of unauthenticated connections described
+// by target: an http:// or https:// URL to reverse proxy, a directory of
+// static files, or a host:port to pipe the decrypted stream to.
+func (s *TLSServer) newFallback(target string) (func(net.Conn), error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			// The real site only knows its own name.
+			r.Host = u.Host
+		}
+		return serveHTTP(proxy), nil
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return serveHTTP(http.FileServer(http.Dir(target))), nil
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("%q is no URL, directory or address", target)
+	}
+	return func(conn net.Conn) {
+		s.pipeTo(conn, target)
+	}, nil
+}
+
+// serveHTTP returns a fallback answering HTTP requests with handler.
+func serveHTTP(handler http.Handler) func(net.Conn) {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return func(conn net.Conn) {
+		server.Serve(&connListener{conn: conn, done: make(chan struct{})})
+	}
+}
+
+// connListener accepts only conn and then blocks until it is closed, so
+// that http.Server.Serve returns once the connection is done.
+type connListener struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return &closeNotifyConn{conn, l}, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "fallback" }
+
+// closeNotifyConn closes its listener along with itself.
+type closeNotifyConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.l.Close()
+	return err
+}
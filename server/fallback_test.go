@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// get sends a GET request for path with host over a connection handled by
+// fallback and returns the status and body of the response.
+func get(t *testing.T, fallback func(net.Conn), host, path string) (int, string) {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		defer b.Close()
+		fallback(b)
+	}()
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("GET", "http://"+host+path, nil)
+	go req.Write(a)
+	resp, err := http.ReadResponse(bufio.NewReader(a), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestFallbackDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("it works"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := (&TLSServer{}).newFallback(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(t, fallback, "tunnel.example.com", "/"); status != http.StatusOK || body != "it works" {
+		t.Errorf("got %d %q", status, body)
+	}
+	if status, _ := get(t, fallback, "tunnel.example.com", "/missing"); status != http.StatusNotFound {
+		t.Errorf("got %d for a missing file", status)
+	}
+}
+
+func TestFallbackURL(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer site.Close()
+	fallback, err := (&TLSServer{}).newFallback(site.URL + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The site is asked with its own name, not the tunnel's.
+	want := site.Listener.Addr().String() + "/base/page"
+	if status, body := get(t, fallback, "tunnel.example.com", "/page"); status != http.StatusOK || body != want {
+		t.Errorf("got %d %q, want %q", status, body, want)
+	}
+}
+
+func TestFallbackAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\nConnection: close\r\n\r\npipe"))
+		ioutil.ReadAll(conn)
+	}()
+	fallback, err := (&TLSServer{}).newFallback(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(t, fallback, "tunnel.example.com", "/"); status != http.StatusOK || body != "pipe" {
+		t.Errorf("got %d %q", status, body)
+	}
+}
+
+func TestFallbackInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"nonsense", file, filepath.Join(file, "missing")} {
+		if _, err := (&TLSServer{}).newFallback(target); err == nil {
+			t.Errorf("newFallback(%q) succeeded", target)
+		}
+	}
+}
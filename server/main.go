@@ -1,21 +1,28 @@
 package main
 
 import (
-	"golang.org/x/crypto/acme/autocert"
+	"github.com/Catofes/SniGateway/certs"
 	"crypto/tls"
-	"sync"
+	"crypto/x509"
+	"github.com/Catofes/SniGateway/drain"
+	"errors"
+	"fmt"
+	"strings"
+	"strconv"
+	"time"
 	"net"
 	"github.com/op/go-logging"
 	"os"
-	"io"
-	"strings"
+	"github.com/Catofes/SniGateway/internal/prefixconn"
+	"github.com/Catofes/SniGateway/tunnel"
 	"flag"
 )
 
 var log *logging.Logger
 
+var debug = flag.Bool("d", false, "Debug Mode.")
+
 func init() {
-	debug := flag.Bool("-d", false, "Debug Mode.")
 	log = logging.MustGetLogger("example")
 	backend := logging.NewLogBackend(os.Stdout, "", 0)
 	format := logging.MustStringFormatter(
@@ -23,49 +30,110 @@ func init() {
 	)
 	backendFormatter := logging.NewBackendFormatter(backend, format)
 	backendLeveled := logging.AddModuleLevel(backendFormatter)
-	if *debug {
-		backendLeveled.SetLevel(logging.DEBUG, "")
-	} else {
-		backendLeveled.SetLevel(logging.WARNING, "")
-	}
+	backendLeveled.SetLevel(logging.WARNING, "")
 	logging.SetBackend(backendLeveled)
 }
 
 type TLSServer struct {
-	certManager    *autocert.Manager
+	certManager    *certs.Manager
 	ListenAddress  string
 	BackendAddress string
-	Domain         string
-	certPath       string
-	keyPath        string
+	// Domain is one or more comma separated names to get certificates for
+	// with ACME, unless the cert and key files already cover them.
+	Domain     string
+	certPath   string
+	keyPath    string
+	certConfig certs.Config
+	// DrainTimeout is how long open tunnels may keep running after SIGINT
+	// or SIGTERM.
+	DrainTimeout time.Duration
+	tracker      drain.Tracker
+
+	// Only clients passing every configured check, a certificate signed by
+	// clientCAs, the token header and the alpn protocol, are let through to
+	// BackendAddress. Everyone else completes the handshake like with any
+	// web server and is handed to the fallback, or closed if there is none.
+	caPath    string
+	clientCAs *x509.CertPool
+	token     []byte
+	alpn      string
+	// Fallback is a host:port to pipe to, an http:// or https:// URL to
+	// reverse proxy or a directory of static files to serve.
+	Fallback string
+	fallback func(net.Conn)
+
+	// mux accepts clients carrying their tunnels as streams over one
+	// connection, besides plain ones. keepAlive is how often such clients
+	// are pinged.
+	mux       bool
+	keepAlive time.Duration
+	closing   chan struct{}
+
+	// echKeys decrypt ClientHellos encrypted with ECH. The first one is
+	// offered to clients using a config the server has no key for.
+	echKeys []tls.EncryptedClientHelloKey
 }
 
 func (s *TLSServer) Init() *TLSServer {
-	SS_LOCAL_HOST := os.Getenv("SS_LOCAL_HOST")
-	SS_REMOTE_HOST := os.Getenv("SS_REMOTE_HOST")
-	SS_LOCAL_PORT := os.Getenv("SS_LOCAL_PORT")
-	SS_REMOTE_PORT := os.Getenv("SS_REMOTE_PORT")
-	SS_PLUGIN_OPTIONS := os.Getenv("SS_PLUGIN_OPTIONS")
-	s.ListenAddress = SS_REMOTE_HOST + ":" + SS_REMOTE_PORT
-	s.BackendAddress = SS_LOCAL_HOST + ":" + SS_LOCAL_PORT
-	s.LoadOption(SS_PLUGIN_OPTIONS)
-	s.certManager = &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(s.Domain),
-		Cache:      autocert.DirCache("certs"),
+	s.DrainTimeout = 30 * time.Second
+	s.closing = make(chan struct{})
+	var options tunnel.Options
+	if tunnel.Launched() {
+		flag.Parse()
+		plugin := tunnel.LoadPlugin()
+		s.ListenAddress = plugin.RemoteAddress()
+		s.BackendAddress = plugin.LocalAddress()
+		options = tunnel.ParseOptions(plugin.Options, optionAliases)
+	} else {
+		standalone, err := tunnel.LoadStandalone(optionAliases)
+		if err != nil {
+			log.Fatalf("Load config failed. %s", err.Error())
+		}
+		s.ListenAddress = standalone.Listen
+		s.BackendAddress = standalone.Backend
+		options = standalone.Options
 	}
+	// The flags are only parsed now, after init set up the log.
+	if *debug {
+		logging.SetLevel(logging.DEBUG, "")
+	}
+	s.LoadOption(options)
+	if s.caPath != "" {
+		pool, err := tunnel.LoadCertPool(s.caPath)
+		if err != nil {
+			log.Fatalf("Load CA failed. %s", err.Error())
+		}
+		s.clientCAs = pool
+	}
+	if s.Fallback != "" {
+		fallback, err := s.newFallback(s.Fallback)
+		if err != nil {
+			log.Fatalf("Invalid fallback. %s", err.Error())
+		}
+		s.fallback = fallback
+	}
+	if s.certPath != "" {
+		s.certConfig.Pairs = []certs.Pair{{Cert: s.certPath, Key: s.keyPath}}
+	}
+	if s.Domain != "" {
+		s.certConfig.Hosts = strings.Split(s.Domain, ",")
+	}
+	manager, err := certs.NewManager(s.certConfig)
+	if err != nil {
+		log.Fatalf("Load cert failed. %s", err.Error())
+	}
+	s.certManager = manager
 	return s
 }
 
-func (s *TLSServer) LoadOption(option string) {
-	data := strings.Split(option, ";")
-	for _, v := range data {
-		d := strings.Split(v, "=")
-		if len(d) != 2 {
-			continue
-		}
-		key := d[0]
-		value := d[1]
+// optionAliases maps the option names other SIP003 plugins use onto ours.
+var optionAliases = map[string]string{
+	"host": "domain",
+	"sni":  "domain",
+}
+
+func (s *TLSServer) LoadOption(options tunnel.Options) {
+	for key, value := range options {
 		switch key {
 		case "domain":
 			s.Domain = value
@@ -73,42 +141,91 @@ func (s *TLSServer) LoadOption(option string) {
 			s.certPath = value
 		case "key":
 			s.keyPath = value
+		case "acme-directory":
+			s.certConfig.DirectoryURL = value
+		case "acme-ca":
+			s.certConfig.DirectoryCA = value
+		case "acme-email":
+			s.certConfig.Email = value
+		case "acme-http":
+			s.certConfig.HTTPAddress = value
+		case "cache":
+			s.certConfig.CacheDir = value
+		case "ca":
+			s.caPath = value
+		case "token":
+			s.token = tunnel.TokenHeader(value)
+		case "alpn":
+			s.alpn = value
+		case "fallback":
+			s.Fallback = value
+		case "drain":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				s.DrainTimeout = time.Duration(seconds) * time.Second
+			}
+		case "mux":
+			s.mux = value == "" || tunnel.String2Bool(value)
+		case "ech-key":
+			s.echKeys = nil
+			for i, path := range strings.Split(value, ",") {
+				key, err := tunnel.LoadECHKey(path, i == 0)
+				if err != nil {
+					log.Fatalf("Load ECH key failed. %s", err.Error())
+				}
+				s.echKeys = append(s.echKeys, key)
+			}
+		case "keepalive":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				s.keepAlive = time.Duration(seconds) * time.Second
+			}
 		}
 	}
 }
 
 func (s *TLSServer) Listen() {
 	var config *tls.Config
-	if s.certPath == "" {
-		config = &tls.Config{GetCertificate: s.certManager.GetCertificate}
+	if s.alpn != "" {
+		config = s.certManager.TLSConfig(s.alpn, "http/1.1")
 	} else {
-		cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
-		if err != nil {
-			log.Fatalf("Load cert failed. %s", err.Error())
-		}
-		config = &tls.Config{}
-		config.Certificates = append(config.Certificates, cert)
+		config = s.certManager.TLSConfig()
+	}
+	if err := s.certManager.Start(); err != nil {
+		log.Fatalf("Watch cert failed. %s", err.Error())
+	}
+	defer s.certManager.Close()
+	config.EncryptedClientHelloKeys = s.echKeys
+	if s.clientCAs != nil {
+		// Verified in handleConn, so that a bad certificate does not fail
+		// the handshake with an alert.
+		config.ClientAuth = tls.RequestClientCert
 	}
 	ln, err := tls.Listen("tcp", s.ListenAddress, config)
 	if err != nil {
 		log.Fatalf("Error Listen Port. %s", err.Error())
 	}
-	defer ln.Close()
-	wg := &sync.WaitGroup{}
+	go func() {
+		sig := drain.WaitSignal()
+		log.Warningf("Received %v, shutting down.", sig)
+		close(s.closing)
+		ln.Close()
+	}()
 	for {
 		conn, err := ln.Accept()
-		log.Debug("Accept connection.")
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			log.Warningf("Can not accept conn. %s", err.Error())
 			continue
 		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			s.handleConn(conn)
-		}()
+		log.Debug("Accept connection.")
+		s.tracker.Go(conn, s.handleConn)
+	}
+	summary := s.tracker.Drain(s.DrainTimeout)
+	log.Warningf("Shutdown finished, %v.", summary)
+	for _, conn := range summary.Forced {
+		log.Warningf("Cut off %s", conn)
 	}
-	wg.Wait()
 }
 
 func (s *TLSServer) handleConn(conn net.Conn) {
@@ -117,50 +234,82 @@ func (s *TLSServer) handleConn(conn net.Conn) {
 	err := upConn.Handshake()
 	if err != nil {
 		log.Debugf("TLS handshake failed. %s", err.Error())
+		return
 	}
 	log.Debugf("accepted: %s", conn.RemoteAddr())
-	downConn, err := net.Dial("tcp", s.BackendAddress)
+	client, err := s.authenticate(upConn)
 	if err != nil {
-		log.Warningf("unable to connect to %s: %s", s.BackendAddress, err)
+		log.Debugf("Client %s not authenticated. %s", conn.RemoteAddr(), err.Error())
+		if client != nil && s.fallback != nil {
+			s.fallback(client)
+		}
 		return
 	}
-	defer downConn.Close()
-	if err := s.Pipe(upConn, downConn); err != nil {
-		log.Warningf("pipe failed: %s", err)
-	} else {
-		log.Debugf("disconnected: %s", upConn.RemoteAddr())
+	if s.mux {
+		// Plain clients of protocols where the server speaks first send
+		// nothing, so they are piped once the header does not come.
+		client.SetReadDeadline(time.Now().Add(muxHeaderTimeout))
+		ok, seen, err := tunnel.ReadToken(client, tunnel.MuxHeader)
+		client.SetReadDeadline(time.Time{})
+		var timeout net.Error
+		switch {
+		case ok:
+			s.serveMux(client)
+			return
+		case err != nil && !(errors.As(err, &timeout) && timeout.Timeout()):
+			log.Debugf("Read from %s failed. %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		client = &prefixconn.Conn{Conn: client, Prefix: seen}
 	}
+	s.pipeTo(client, s.BackendAddress)
 }
 
-func (s *TLSServer) Pipe(a, b net.Conn) error {
-	done := make(chan error, 1)
-	cp := func(r, w net.Conn) {
-		n, err := io.Copy(w, r)
-		log.Debugf("copied %d bytes from %s to %s", n, r.RemoteAddr(), w.RemoteAddr())
-		switch wc := w.(type) {
-		case *tls.Conn:
-			wc.CloseWrite()
-		case *net.TCPConn:
-			wc.CloseWrite()
+// authenticate checks conn against every configured method. It returns
+// the connection to hand on, which replays any bytes read while looking
+// for the token, or nil if it is not worth handing on.
+func (s *TLSServer) authenticate(conn *tls.Conn) (net.Conn, error) {
+	state := conn.ConnectionState()
+	if s.clientCAs != nil {
+		if err := tunnel.VerifyClient(state.PeerCertificates, s.clientCAs); err != nil {
+			return conn, err
 		}
-		switch rc := r.(type) {
-		case *tls.Conn:
-		case *net.TCPConn:
-			rc.CloseRead()
+	}
+	if s.alpn != "" && state.NegotiatedProtocol != s.alpn {
+		return conn, fmt.Errorf("ALPN protocol %q", state.NegotiatedProtocol)
+	}
+	if s.token != nil {
+		conn.SetReadDeadline(time.Now().Add(tokenTimeout))
+		ok, seen, err := tunnel.ReadToken(conn, s.token)
+		conn.SetReadDeadline(time.Time{})
+		var timeout net.Error
+		switch {
+		case ok:
+		case err == nil:
+			return &prefixconn.Conn{Conn: conn, Prefix: seen}, errors.New("wrong token")
+		case errors.As(err, &timeout) && timeout.Timeout():
+			return &prefixconn.Conn{Conn: conn, Prefix: seen}, errors.New("no token")
+		default:
+			return nil, err
 		}
-		done <- err
 	}
-	go cp(a, b)
-	go cp(b, a)
-	err1 := <-done
-	err2 := <-done
-	if err1 != nil {
-		return err1
+	return conn, nil
+}
+
+// pipeTo connects conn with a new connection to address.
+func (s *TLSServer) pipeTo(conn net.Conn, address string) {
+	downConn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Warningf("unable to connect to %s: %s", address, err)
+		return
 	}
-	if err2 != nil {
-		return err2
+	defer downConn.Close()
+	defer s.tracker.Track(downConn)()
+	if err := tunnel.Pipe(conn, downConn); err != nil {
+		log.Warningf("pipe failed: %s", err)
+	} else {
+		log.Debugf("disconnected: %s", conn.RemoteAddr())
 	}
-	return nil
 }
 
 func main() {
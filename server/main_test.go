@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Catofes/SniGateway/tunnel"
+)
+
+// testCert makes a certificate for names signed by parent, or a CA signing
+// itself if parent is nil.
+func testCert(t *testing.T, parent *tls.Certificate, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type authResult struct {
+	// handedOn is whether authenticate returned a connection, and read what
+	// could be read from it.
+	handedOn bool
+	read     string
+	err      error
+}
+
+// authenticate runs s.authenticate on one connection made with client, over
+// which send is written before the client waits for linger and closes.
+func authenticate(t *testing.T, s *TLSServer, client *tls.Config, send string, linger time.Duration) authResult {
+	t.Helper()
+	ca := testCert(t, nil)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, &ca, "tunnel.example.com")},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	if s.alpn != "" {
+		config.NextProtos = []string{s.alpn, "http/1.1"}
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	results := make(chan authResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- authResult{err: err}
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			results <- authResult{err: err}
+			return
+		}
+		handed, err := s.authenticate(tc)
+		result := authResult{handedOn: handed != nil, err: err}
+		if handed != nil {
+			handed.SetReadDeadline(time.Now().Add(5 * time.Second))
+			data, _ := ioutil.ReadAll(handed)
+			result.read = string(data)
+		}
+		results <- result
+	}()
+
+	client.InsecureSkipVerify = true
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", ln.Addr().String(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(send))
+	time.Sleep(linger)
+	conn.Close()
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(10 * time.Second):
+		t.Fatal("authenticate did not return")
+	}
+	return authResult{}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tokenTimeout = 200 * time.Millisecond
+	defer func() { tokenTimeout = 10 * time.Second }()
+	ca := testCert(t, nil)
+	otherCA := testCert(t, nil)
+	clientCert := testCert(t, &ca)
+	otherCert := testCert(t, &otherCA)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	token := tunnel.TokenHeader("secret")
+	wrongToken := string(tunnel.TokenHeader("wrong"))
+	partToken := string(token[:4])
+
+	tests := []struct {
+		name   string
+		server *TLSServer
+		client *tls.Config
+		send   string
+		linger time.Duration
+		// fail is part of the error authenticate fails with, if it fails.
+		fail     string
+		handedOn bool
+		read     string
+	}{
+		{"no checks", &TLSServer{}, &tls.Config{}, "hello", 0, "", true, "hello"},
+		{"ca", &TLSServer{clientCAs: clientCAs}, &tls.Config{Certificates: []tls.Certificate{clientCert}}, "hello", 0, "", true, "hello"},
+		{"ca without certificate", &TLSServer{clientCAs: clientCAs}, &tls.Config{}, "GET /", 0, "no client certificate", true, "GET /"},
+		{"ca of another CA", &TLSServer{clientCAs: clientCAs}, &tls.Config{Certificates: []tls.Certificate{otherCert}}, "GET /", 0, "unknown authority", true, "GET /"},
+		{"alpn", &TLSServer{alpn: "x-tun"}, &tls.Config{NextProtos: []string{"x-tun"}}, "hello", 0, "", true, "hello"},
+		{"alpn of a browser", &TLSServer{alpn: "x-tun"}, &tls.Config{NextProtos: []string{"h2", "http/1.1"}}, "GET /", 0, `ALPN protocol "http/1.1"`, true, "GET /"},
+		{"alpn not offered", &TLSServer{alpn: "x-tun"}, &tls.Config{}, "GET /", 0, `ALPN protocol ""`, true, "GET /"},
+		// The token is consumed, what follows it is handed on.
+		{"token", &TLSServer{token: token}, &tls.Config{}, string(token) + "hello", 0, "", true, "hello"},
+		// Without the token, everything read is handed on again.
+		{"wrong token", &TLSServer{token: token}, &tls.Config{}, wrongToken, 0, "wrong token", true, wrongToken},
+		{"no token", &TLSServer{token: token}, &tls.Config{}, partToken, 500 * time.Millisecond, "no token", true, partToken},
+		{"closed in the token", &TLSServer{token: token}, &tls.Config{}, partToken, 0, "EOF", false, ""},
+		{"every check", &TLSServer{clientCAs: clientCAs, alpn: "x-tun", token: token},
+			&tls.Config{Certificates: []tls.Certificate{clientCert}, NextProtos: []string{"x-tun"}},
+			string(token) + "hello", 0, "", true, "hello"},
+		{"every check but the token", &TLSServer{clientCAs: clientCAs, alpn: "x-tun", token: token},
+			&tls.Config{Certificates: []tls.Certificate{clientCert}, NextProtos: []string{"x-tun"}},
+			wrongToken, 0, "wrong token", true, wrongToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := authenticate(t, test.server, test.client, test.send, test.linger)
+			switch {
+			case test.fail == "" && result.err != nil:
+				t.Errorf("authenticate failed: %s", result.err)
+			case test.fail != "" && result.err == nil:
+				t.Error("authenticate succeeded")
+			case result.err != nil && !strings.Contains(result.err.Error(), test.fail):
+				t.Errorf("authenticate failed with %q, want %q", result.err, test.fail)
+			}
+			if result.handedOn != test.handedOn {
+				t.Errorf("handed on = %v, want %v", result.handedOn, test.handedOn)
+			}
+			if result.read != test.read {
+				t.Errorf("handed on %q, want %q", result.read, test.read)
+			}
+		})
+	}
+}
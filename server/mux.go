@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Catofes/SniGateway/tunnel"
+	"github.com/hashicorp/yamux"
+)
+
+// muxHeaderTimeout is how long a client has to start with the mux header
+// after authenticating before it is taken for a plain one.
+var muxHeaderTimeout = 2 * time.Second
+
+// serveMux pipes every stream the client opens on conn to BackendAddress.
+// On shutdown the client is told to open no more streams, and the session
+// ends once the open ones are done.
+func (s *TLSServer) serveMux(conn net.Conn) {
+	session, err := yamux.Server(conn, tunnel.MuxConfig(s.keepAlive))
+	if err != nil {
+		log.Warningf("Start mux session failed. %s", err.Error())
+		return
+	}
+	defer session.Close()
+	log.Debugf("mux session from %s", conn.RemoteAddr())
+	var streams sync.WaitGroup
+	go func() {
+		select {
+		case <-s.closing:
+			session.GoAway()
+			streams.Wait()
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer stream.Close()
+			s.pipeTo(&tunnel.MuxStream{Stream: stream}, s.BackendAddress)
+		}()
+	}
+	streams.Wait()
+	log.Debugf("mux session from %s closed", conn.RemoteAddr())
+}
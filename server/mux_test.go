@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Catofes/SniGateway/tunnel"
+	"github.com/hashicorp/yamux"
+)
+
+// greeter accepts connections that it greets first, like an SMTP server,
+// and then echoes.
+func greeter(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("hi"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// muxServer serves s on a TLS listener and returns its address.
+func muxServer(t *testing.T, s *TLSServer) string {
+	t.Helper()
+	ca := testCert(t, nil)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert(t, &ca, "tunnel.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMuxPlainClient(t *testing.T) {
+	muxHeaderTimeout = 200 * time.Millisecond
+	defer func() { muxHeaderTimeout = 2 * time.Second }()
+	s := &TLSServer{BackendAddress: greeter(t), mux: true, closing: make(chan struct{})}
+	address := muxServer(t, s)
+
+	// A plain client waiting for the backend to speak first is piped
+	// once the mux header does not come.
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != "hi" {
+		t.Fatalf("greeting %q, %v", greeting, err)
+	}
+
+	// A mux client opens streams.
+	conn, err = tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(tunnel.MuxHeader); err != nil {
+		t.Fatal(err)
+	}
+	// Well past the header timeout, which must not end the session.
+	time.Sleep(400 * time.Millisecond)
+	session, err := yamux.Client(conn, tunnel.MuxConfig(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for i := 0; i < 2; i++ {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		stream.Write([]byte("ok"))
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "hiok" {
+			t.Errorf("stream %d read %q, %v", i, reply, err)
+		}
+		stream.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+)
+
+// TokenHeader is what a client sends first to authenticate with the pre-shared
+// token. It is a hash so that it looks like random bytes on the wire and
+// does not start like any common protocol.
+func TokenHeader(token string) []byte {
+	sum := sha256.Sum256([]byte("SniGateway tunnel token\x00" + token))
+	return sum[:]
+}
+
+// ReadToken reads from conn for as long as the input still matches header,
+// so a prober sending anything else is answered without waiting for more
+// bytes. It returns whether the whole header was read, and otherwise the
+// bytes read, which belong to whoever handles the connection instead.
+func ReadToken(conn net.Conn, header []byte) (bool, []byte, error) {
+	buf := make([]byte, len(header))
+	read := 0
+	for read < len(header) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if !bytes.Equal(buf[:read], header[:read]) {
+			return false, buf[:read], nil
+		}
+		if err != nil {
+			if err == io.EOF && read < len(header) {
+				err = io.ErrUnexpectedEOF
+			}
+			return false, buf[:read], err
+		}
+	}
+	return true, nil, nil
+}
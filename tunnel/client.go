@@ -0,0 +1,132 @@
+// Package tunnel is the common core of the tunnel clients: it accepts local
+// connections and pipes each of them through an upstream connection made by
+// a pluggable Dialer.
+package tunnel
+
+import (
+	"errors"
+	"github.com/Catofes/SniGateway/drain"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Dialer establishes the upstream side of a tunnel.
+type Dialer interface {
+	Dial() (net.Conn, error)
+}
+
+// Client listens on ListenAddress and tunnels every connection through
+// Dialer.
+type Client struct {
+	ListenAddress string
+	Dialer        Dialer
+	// VPNMode asks the Android binaries to protect upstream sockets from
+	// the VPN.
+	VPNMode bool
+	// DrainTimeout is how long open connections may keep running after
+	// SIGINT or SIGTERM.
+	DrainTimeout time.Duration
+	tracker      drain.Tracker
+}
+
+// Init sets the defaults of the common options.
+func (s *Client) Init() *Client {
+	s.VPNMode = true
+	s.DrainTimeout = 30 * time.Second
+	return s
+}
+
+// SetOption applies a plugin option shared by every client and reports
+// whether key was one.
+func (s *Client) SetOption(key, value string) bool {
+	switch key {
+	case "Mode":
+		s.VPNMode = String2Bool(value)
+	case "drain":
+		if seconds, err := strconv.Atoi(value); err == nil {
+			s.DrainTimeout = time.Duration(seconds) * time.Second
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Client) Listen() {
+	ln, err := net.Listen("tcp", s.ListenAddress)
+	if err != nil {
+		log.Fatalf("Error Listen Port. %s", err.Error())
+	}
+	go func() {
+		sig := drain.WaitSignal()
+		log.Warningf("Received %v, shutting down.", sig)
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Warningf("Can not accept conn. %s", err.Error())
+			continue
+		}
+		log.Debug("Accept connection.")
+		s.tracker.Go(conn, s.handleConn)
+	}
+	summary := s.tracker.Drain(s.DrainTimeout)
+	if closer, ok := s.Dialer.(io.Closer); ok {
+		closer.Close()
+	}
+	log.Warningf("Shutdown finished, %v.", summary)
+	for _, conn := range summary.Forced {
+		log.Warningf("Cut off %s", conn)
+	}
+}
+
+func (s *Client) handleConn(conn net.Conn) {
+	defer conn.Close()
+	log.Debugf("accepted: %s", conn.RemoteAddr())
+	upConn, err := s.Dialer.Dial()
+	if err != nil {
+		log.Warningf("Connect upstream failed: %s", err)
+		return
+	}
+	defer upConn.Close()
+	defer s.tracker.Track(upConn)()
+	if err := Pipe(conn, upConn); err != nil {
+		log.Warningf("pipe failed: %s", err)
+	} else {
+		log.Debugf("disconnected: %s", conn.RemoteAddr())
+	}
+}
+
+// Pipe copies between a and b until both directions are done, half-closing
+// each side as its input ends.
+func Pipe(a, b net.Conn) error {
+	done := make(chan error, 2)
+	cp := func(r, w net.Conn) {
+		n, err := io.Copy(w, r)
+		log.Debugf("copied %d bytes from %s to %s", n, r.RemoteAddr(), w.RemoteAddr())
+		if wc, ok := w.(interface{ CloseWrite() error }); ok {
+			wc.CloseWrite()
+		}
+		if rc, ok := r.(interface{ CloseRead() error }); ok {
+			rc.CloseRead()
+		}
+		done <- err
+	}
+	go cp(a, b)
+	go cp(b, a)
+	err1 := <-done
+	err2 := <-done
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
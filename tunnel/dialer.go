@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Catofes/SniGateway/internal/prefixconn"
+	utls "github.com/refraction-networking/utls"
+)
+
+// TLSDialer connects to Address over TLS.
+type TLSDialer struct {
+	Address string
+	Config  *tls.Config
+	// Preamble, if any, is sent right after the handshake, such as the
+	// TokenHeader a TLSServer authenticates clients by.
+	Preamble []byte
+	// Fingerprint, if set, names the browser in Fingerprints whose
+	// ClientHello to send.
+	Fingerprint string
+
+	once    sync.Once
+	uconfig *utls.Config
+}
+
+func (d *TLSDialer) Dial() (net.Conn, error) {
+	conn, err := d.dial()
+	// Random hellos now and then offer groups the server asks to retry
+	// with but that no key can be made for. Another one usually works.
+	for i := 1; err != nil && i < 3 && strings.HasPrefix(d.Fingerprint, "random"); i++ {
+		log.Debugf("Retry with another random ClientHello. %s", err)
+		conn, err = d.dial()
+	}
+	return conn, err
+}
+
+func (d *TLSDialer) dial() (net.Conn, error) {
+	tcpConn, err := net.Dial("tcp", d.Address)
+	if err != nil {
+		return nil, fmt.Errorf("TCP connect to %s failed: %s", d.Address, err)
+	}
+	var conn net.Conn
+	if d.Fingerprint != "" {
+		conn, err = d.handshakeFingerprint(tcpConn)
+	} else {
+		tc := tls.Client(tcpConn, d.Config)
+		conn, err = tc, tc.Handshake()
+	}
+	if err != nil {
+		tcpConn.Close()
+		var rejected *tls.ECHRejectionError
+		if errors.As(err, &rejected) && len(rejected.RetryConfigList) > 0 {
+			log.Warningf("Server rejected ECH, it offers ech=%s", base64.StdEncoding.EncodeToString(rejected.RetryConfigList))
+		}
+		return nil, fmt.Errorf("TLS handshake to %s(%s) failed: %s", d.Address, d.Config.ServerName, err)
+	}
+	if len(d.Preamble) > 0 {
+		if _, err := conn.Write(d.Preamble); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Send preamble to %s failed: %s", d.Address, err)
+		}
+	}
+	return conn, nil
+}
+
+// HeaderField is one line of a request header, kept in order since some
+// proxies care about it.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// maxConnectResponse bounds the response to a CONNECT request.
+const maxConnectResponse = 8192
+
+// ConnectDialer opens a tunnel to Target through the HTTP proxy at Address
+// with a CONNECT request carrying Header.
+type ConnectDialer struct {
+	Address string
+	Target  string
+	Header  []HeaderField
+}
+
+func (d *ConnectDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.Address)
+	if err != nil {
+		return nil, fmt.Errorf("TCP connect to %s failed: %s", d.Address, err)
+	}
+	tunnel, err := d.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (d *ConnectDialer) handshake(conn net.Conn) (net.Conn, error) {
+	var request strings.Builder
+	fmt.Fprintf(&request, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", d.Target, d.Target)
+	for _, field := range d.Header {
+		fmt.Fprintf(&request, "%s: %s\r\n", field.Name, field.Value)
+	}
+	request.WriteString("\r\n")
+	log.Debug(request.String())
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	var response strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		response.WriteString(line)
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+		if response.Len() > maxConnectResponse {
+			return nil, fmt.Errorf("CONNECT %s through %s failed: response too long", d.Target, d.Address)
+		}
+	}
+	// Some of these proxies answer in their own way, so any response saying
+	// so is taken, whatever its status.
+	if !strings.Contains(response.String(), "Connection established") {
+		log.Debugf("Handshake failed: %s.", response.String())
+		status := strings.TrimSpace(strings.SplitN(response.String(), "\n", 2)[0])
+		return nil, fmt.Errorf("CONNECT %s through %s failed: %s", d.Target, d.Address, status)
+	}
+	log.Debug("handshake finished.")
+	if n := r.Buffered(); n > 0 {
+		// Tunnel data read along with the response.
+		buffered, _ := r.Peek(n)
+		return &prefixconn.Conn{Conn: conn, Prefix: buffered}, nil
+	}
+	return conn, nil
+}
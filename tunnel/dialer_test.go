@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// connectProxy answers one CONNECT request with response and closes.
+func connectProxy(t *testing.T, response string) (string, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		conn.Write([]byte(response))
+	}()
+	return ln.Addr().String(), requests
+}
+
+func TestConnectDialer(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		ok       bool
+		data     string
+	}{
+		{"established", "HTTP/1.1 200 Connection established\r\n\r\n", true, ""},
+		{"with headers and data", "HTTP/1.0 200 Connection established\r\nProxy-agent: test\r\n\r\nhello", true, "hello"},
+		{"own status line", "HTTP/1.1 0 Connection established\n\nhi", true, "hi"},
+		{"refused", "HTTP/1.1 403 Forbidden\r\n\r\n", false, ""},
+		{"plain ok", "HTTP/1.1 200 OK\r\n\r\n", false, ""},
+		{"cut off", "HTTP/1.1 200 Connection established\r\n", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, requests := connectProxy(t, test.response)
+			d := &ConnectDialer{
+				Address: address,
+				Target:  "example.com:443",
+				Header:  []HeaderField{{"Q-GUID", "id"}, {"Q-Token", "key"}},
+			}
+			conn, err := d.Dial()
+			if !test.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Dial succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != "example.com:443" || req.Header.Get("Q-Token") != "key" {
+				t.Errorf("proxy got %s %s %v", req.Method, req.Host, req.Header)
+			}
+			data, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.data {
+				t.Errorf("tunnel data %q, want %q", data, test.data)
+			}
+			if _, ok := conn.(interface{ CloseWrite() error }); !ok {
+				t.Error("tunnel cannot half-close")
+			}
+		})
+	}
+}
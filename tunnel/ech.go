@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ECH keys are kept in the PEM file format of OpenSSL and BoringSSL: the
+// PKCS #8 private key followed by the ECHConfigList clients need.
+const (
+	pemPrivateKey = "PRIVATE KEY"
+	pemECHConfig  = "ECHCONFIG"
+)
+
+// The HPKE algorithms of generated configs, which every ECH implementation
+// supports.
+const (
+	echVersion    = 0xfe0d
+	kemX25519     = 0x0020
+	kdfHKDFSHA256 = 0x0001
+	aeadAES128GCM = 0x0001
+)
+
+// GenerateECH returns a new ECH key and a PEM file holding it along with
+// its ECHConfigList, in which clients find publicName as the name to show
+// in the outer ClientHello.
+func GenerateECH(publicName string, configID uint8) ([]byte, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, errors.New("public name must have 1 to 255 bytes")
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var config []byte
+	config = append(config, configID)
+	config = binary.BigEndian.AppendUint16(config, kemX25519)
+	config = appendVector16(config, key.PublicKey().Bytes())
+	config = appendVector16(config, []byte{0, kdfHKDFSHA256, 0, aeadAES128GCM})
+	config = append(config, 0) // maximum_name_length
+	config = append(config, byte(len(publicName)))
+	config = append(config, publicName...)
+	config = appendVector16(config, nil) // extensions
+	echConfig := binary.BigEndian.AppendUint16(nil, echVersion)
+	echConfig = appendVector16(echConfig, config)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	pem.Encode(&out, &pem.Block{Type: pemPrivateKey, Bytes: der})
+	pem.Encode(&out, &pem.Block{Type: pemECHConfig, Bytes: appendVector16(nil, echConfig)})
+	return out.Bytes(), nil
+}
+
+// LoadECHKey reads a key written by GenerateECH for a TLSServer. Clients
+// that fail ECH are offered the configs of keys with retry set.
+func LoadECHKey(path string, retry bool) (tls.EncryptedClientHelloKey, error) {
+	var key tls.EncryptedClientHelloKey
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return key, err
+	}
+	var list []byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case pemPrivateKey:
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return key, fmt.Errorf("%s: %s", path, err)
+			}
+			private, ok := parsed.(*ecdh.PrivateKey)
+			if !ok || private.Curve() != ecdh.X25519() {
+				return key, fmt.Errorf("%s: not an X25519 key", path)
+			}
+			key.PrivateKey = private.Bytes()
+		case pemECHConfig:
+			list = block.Bytes
+		}
+	}
+	if key.PrivateKey == nil || list == nil {
+		return key, fmt.Errorf("%s: want a PRIVATE KEY and an ECHCONFIG block", path)
+	}
+	// The server takes the one ECHConfig of the list.
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return key, fmt.Errorf("%s: malformed ECHConfigList", path)
+	}
+	key.Config = list[2:]
+	key.SendAsRetry = retry
+	return key, nil
+}
+
+// LoadECHConfigList returns the ECHConfigList in value, which is either
+// base64 or a file holding it in base64 or in an ECHCONFIG PEM block, such
+// as one written by GenerateECH.
+func LoadECHConfigList(value string) ([]byte, error) {
+	if data, err := ioutil.ReadFile(value); err == nil {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == pemECHConfig {
+				return block.Bytes, nil
+			}
+		}
+		value = string(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	list, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("ECHConfigList is no file or base64: %s", err)
+	}
+	return list, nil
+}
+
+func appendVector16(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
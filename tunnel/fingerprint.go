@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Fingerprints are the browser ClientHellos a TLSDialer can send instead of
+// the one of Go, which is easy to tell apart from browser traffic. The
+// random ones change with every connection.
+var Fingerprints = map[string]utls.ClientHelloID{
+	"chrome":        utls.HelloChrome_Auto,
+	"firefox":       utls.HelloFirefox_Auto,
+	"safari":        utls.HelloSafari_Auto,
+	"ios":           utls.HelloIOS_Auto,
+	"edge":          utls.HelloEdge_Auto,
+	"android":       utls.HelloAndroid_11_OkHttp,
+	"random":        utls.HelloRandomized,
+	"random-alpn":   utls.HelloRandomizedALPN,
+	"random-noalpn": utls.HelloRandomizedNoALPN,
+}
+
+// CheckFingerprint returns an error naming the known fingerprints if name
+// is none of them.
+func CheckFingerprint(name string) error {
+	if _, ok := Fingerprints[name]; ok {
+		return nil
+	}
+	var names []string
+	for n := range Fingerprints {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown fingerprint %q, want one of %s", name, strings.Join(names, ", "))
+}
+
+// fingerprintSpec returns the ClientHello of the browser profile id, with
+// its ALPN protocols replaced by nextProtos if any, as a TLSServer may
+// authenticate clients by a private protocol. Profiles without ALPN get it
+// added before the padding and pre_shared_key extensions, which come last.
+// If resume is set, Chrome gets the pre_shared_key extension it resumes
+// sessions with, which the profile of utls leaves out. It returns nil if
+// the profile can be used as it is.
+func fingerprintSpec(id utls.ClientHelloID, nextProtos []string, resume bool) (*utls.ClientHelloSpec, error) {
+	psk := resume && id.Client == utls.HelloChrome_Auto.Client
+	if (len(nextProtos) == 0 && !psk) || strings.HasPrefix(id.Client, "Randomized") {
+		return nil, nil
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	if psk {
+		spec.Extensions = append(spec.Extensions, &utls.UtlsPreSharedKeyExtension{})
+	}
+	if len(nextProtos) > 0 {
+		setALPN(&spec, nextProtos)
+	}
+	return &spec, nil
+}
+
+func setALPN(spec *utls.ClientHelloSpec, nextProtos []string) {
+	last := len(spec.Extensions)
+	for i, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *utls.ALPNExtension:
+			ext.AlpnProtocols = nextProtos
+			return
+		case *utls.UtlsPaddingExtension, utls.PreSharedKeyExtension:
+			if last == len(spec.Extensions) {
+				last = i
+			}
+		}
+	}
+	alpn := &utls.ALPNExtension{AlpnProtocols: nextProtos}
+	spec.Extensions = append(spec.Extensions[:last], append([]utls.TLSExtension{alpn}, spec.Extensions[last:]...)...)
+}
+
+// uconfig converts the settings of config that a TLSDialer uses.
+func uconfig(config *tls.Config) *utls.Config {
+	u := &utls.Config{
+		ServerName:         config.ServerName,
+		RootCAs:            config.RootCAs,
+		NextProtos:         config.NextProtos,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	for _, cert := range config.Certificates {
+		u.Certificates = append(u.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		})
+	}
+	if config.ClientSessionCache != nil {
+		u.ClientSessionCache = utls.NewLRUClientSessionCache(0)
+		// Some profiles, like the one of Firefox, have no pre_shared_key
+		// extension to resume TLS 1.3 sessions with, for which utls would
+		// panic instead of doing a full handshake.
+		u.PreferSkipResumptionOnNilExtension = true
+		// Browsers only send pre_shared_key when they have a session.
+		u.OmitEmptyPsk = true
+	}
+	if verify := config.VerifyConnection; verify != nil {
+		u.VerifyConnection = func(state utls.ConnectionState) error {
+			return verify(tls.ConnectionState{
+				Version:            state.Version,
+				HandshakeComplete:  state.HandshakeComplete,
+				DidResume:          state.DidResume,
+				CipherSuite:        state.CipherSuite,
+				NegotiatedProtocol: state.NegotiatedProtocol,
+				ServerName:         state.ServerName,
+				PeerCertificates:   state.PeerCertificates,
+				VerifiedChains:     state.VerifiedChains,
+			})
+		}
+	}
+	return u
+}
+
+// handshakeFingerprint runs the client handshake on conn with the
+// ClientHello of the Fingerprint.
+func (d *TLSDialer) handshakeFingerprint(conn net.Conn) (net.Conn, error) {
+	d.once.Do(func() {
+		d.uconfig = uconfig(d.Config)
+	})
+	id := Fingerprints[d.Fingerprint]
+	if id == utls.HelloRandomized && len(d.Config.NextProtos) > 0 {
+		// Random hellos leave out ALPN at times, which a TLSServer
+		// authenticating clients by their protocol would refuse.
+		id = utls.HelloRandomizedALPN
+	}
+	// A fresh spec for every connection, as applying one consumes it and
+	// browsers like Chrome shuffle their extensions each time.
+	spec, err := fingerprintSpec(id, d.Config.NextProtos, d.Config.ClientSessionCache != nil)
+	if err != nil {
+		return nil, err
+	}
+	var uconn *utls.UConn
+	if spec != nil {
+		uconn = utls.UClient(conn, d.uconfig, utls.HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			return nil, err
+		}
+	} else {
+		uconn = utls.UClient(conn, d.uconfig, id)
+	}
+	if err := uconn.Handshake(); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
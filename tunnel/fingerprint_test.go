@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Catofes/SniGateway/clienthello"
+	utls "github.com/refraction-networking/utls"
+)
+
+// sentHello returns the ClientHello d sends with its Fingerprint.
+func sentHello(t *testing.T, d *TLSDialer) *clienthello.ClientHello {
+	t.Helper()
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		defer a.Close()
+		d.handshakeFingerprint(a)
+	}()
+	hello, _, err := clienthello.Read(b, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+// normalize makes GREASE values equal, and leaves out padding, which is
+// only there to bring the hello to some length, and ALPN, which is added to
+// profiles without it.
+func normalize(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		switch {
+		case v&0x0f0f == 0x0a0a && v>>8 == v&0xff:
+			out = append(out, 0x0a0a)
+		case v != 21 && v != 16:
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// helloWant are the cipher suites and extensions of the browser profiles,
+// normalized.
+var helloWant = map[string]struct{ ciphers, extensions []uint16 }{
+	"chrome": {
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		// Sorted, as Chrome shuffles them with every connection.
+		[]uint16{0, 5, 10, 11, 13, 18, 23, 27, 35, 43, 45, 51, 2570, 2570, 17613, 65037, 65281},
+	},
+	"firefox": {
+		[]uint16{0x1301, 0x1303, 0x1302, 0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030, 0xc00a, 0xc009, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]uint16{0, 23, 65281, 10, 11, 35, 5, 34, 51, 43, 13, 45, 28, 65037},
+	},
+	"safari": {
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02c, 0xc02b, 0xcca9, 0xc030, 0xc02f, 0xcca8, 0xc00a, 0xc009, 0xc014, 0xc013, 0x009d, 0x009c, 0x0035, 0x002f, 0xc008, 0xc012, 0x000a},
+		[]uint16{2570, 0, 23, 65281, 10, 11, 5, 13, 18, 51, 45, 43, 27, 2570},
+	},
+	"ios": {
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02c, 0xc02b, 0xcca9, 0xc030, 0xc02f, 0xcca8, 0xc024, 0xc023, 0xc00a, 0xc009, 0xc028, 0xc027, 0xc014, 0xc013, 0x009d, 0x009c, 0x003d, 0x003c, 0x0035, 0x002f, 0xc008, 0xc012, 0x000a},
+		[]uint16{2570, 0, 23, 65281, 10, 11, 5, 13, 18, 51, 45, 43, 2570},
+	},
+	"edge": {
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]uint16{2570, 0, 23, 65281, 10, 11, 35, 5, 13, 18, 51, 45, 43, 27, 2570},
+	},
+	"android": {
+		[]uint16{0xc02b, 0xc02c, 0xcca9, 0xc02f, 0xc030, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]uint16{0, 23, 65281, 10, 11, 5, 13},
+	},
+}
+
+func TestFingerprintSpec(t *testing.T) {
+	for name, want := range helloWant {
+		for _, config := range []*tls.Config{
+			{ServerName: "example.com"},
+			{ServerName: "example.com", NextProtos: []string{"x-tun"}},
+			// Without a session, the pre_shared_key extension is left out.
+			{ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(0)},
+		} {
+			hello := sentHello(t, &TLSDialer{Config: config, Fingerprint: name})
+			if len(config.NextProtos) > 0 && !reflect.DeepEqual(hello.ALPNProtocols, config.NextProtos) {
+				t.Errorf("%s: ALPN %q, want %q", name, hello.ALPNProtocols, config.NextProtos)
+			}
+			if hello.ServerName != "example.com" {
+				t.Errorf("%s: server name %q", name, hello.ServerName)
+			}
+			if got := normalize(hello.CipherSuites); !reflect.DeepEqual(got, want.ciphers) {
+				t.Errorf("%s: cipher suites %#04x, want %#04x", name, got, want.ciphers)
+			}
+			got := normalize(hello.Extensions)
+			if name == "chrome" {
+				sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			}
+			if !reflect.DeepEqual(got, want.extensions) {
+				t.Errorf("%s: extensions %d, want %d", name, got, want.extensions)
+			}
+		}
+	}
+}
+
+// TestFingerprintResume dials twice with a shared session cache, the
+// second time with the session of the first in it, which only profiles
+// with a pre_shared_key extension resume.
+func TestFingerprintResume(t *testing.T) {
+	ca := testCert(t, nil)
+	server := testCert(t, &ca, "tunnel.example.com")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		NextProtos:   []string{"x-tun"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte{1})
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	for name, resume := range map[string]bool{"chrome": true, "firefox": false, "safari": false} {
+		t.Run(name, func(t *testing.T) {
+			d := &TLSDialer{
+				Address: ln.Addr().String(),
+				Config: &tls.Config{
+					ServerName:         "tunnel.example.com",
+					NextProtos:         []string{"x-tun"},
+					ClientSessionCache: tls.NewLRUClientSessionCache(0),
+					InsecureSkipVerify: true,
+				},
+				Fingerprint: name,
+			}
+			for i := 0; i < 2; i++ {
+				conn, err := d.Dial()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Reading takes in the session ticket sent after the
+				// handshake.
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				if did := conn.(*utls.UConn).ConnectionState().DidResume; did != (resume && i == 1) {
+					t.Errorf("connection %d resumed: %v", i, did)
+				}
+			}
+		})
+	}
+}
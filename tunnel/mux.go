@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// DefaultMuxSessions is how many connections a MuxDialer keeps unless told
+// otherwise.
+const DefaultMuxSessions = 4
+
+// MuxHeader is sent by a MuxDialer after any TokenHeader to tell a TLSServer
+// that the connection carries multiplexed streams.
+var MuxHeader = func() []byte {
+	sum := sha256.Sum256([]byte("SniGateway tunnel mux\x00"))
+	return sum[:]
+}()
+
+// MuxConfig is the yamux configuration of both ends of a mux connection,
+// pinging the other end every keepAlive to keep the connection open and
+// detect when it is gone.
+func MuxConfig(keepAlive time.Duration) *yamux.Config {
+	config := yamux.DefaultConfig()
+	if keepAlive > 0 {
+		config.KeepAliveInterval = keepAlive
+	}
+	config.LogOutput = logWriter{}
+	return config
+}
+
+// MuxDialer opens connections as streams over up to Sessions long-lived
+// connections made by Dialer, so most connections need no handshake of
+// their own.
+type MuxDialer struct {
+	Dialer    Dialer
+	Sessions  int
+	KeepAlive time.Duration
+
+	mu       sync.Mutex
+	sessions []*yamux.Session
+	// dialing counts the sessions being dialed, which ready is signaled
+	// about when they are done.
+	dialing int
+	ready   *sync.Cond
+}
+
+func (d *MuxDialer) Dial() (net.Conn, error) {
+	session, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		// The streams already open on it may still be fine.
+		d.drop(session)
+		return nil, fmt.Errorf("Open stream failed: %s", err)
+	}
+	return &MuxStream{stream}, nil
+}
+
+// session returns the session with the fewest streams. While there are
+// fewer than Sessions another one is dialed in the background, and only if
+// there is none yet does the caller wait for a dial.
+func (d *MuxDialer) session() (*yamux.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ready == nil {
+		d.ready = sync.NewCond(&d.mu)
+	}
+	max := d.Sessions
+	if max <= 0 {
+		max = DefaultMuxSessions
+	}
+	for {
+		live := d.sessions[:0]
+		for _, s := range d.sessions {
+			if !s.IsClosed() {
+				live = append(live, s)
+			}
+		}
+		d.sessions = live
+		free := len(d.sessions)+d.dialing < max
+		if len(d.sessions) == 0 && free {
+			d.dialing++
+			d.mu.Unlock()
+			session, err := d.dial()
+			d.mu.Lock()
+			d.added(session)
+			return session, err
+		}
+		if len(d.sessions) > 0 {
+			if free && d.dialing == 0 {
+				d.dialing++
+				go func() {
+					session, err := d.dial()
+					if err != nil {
+						log.Warningf("Open another mux session failed. %s", err)
+					}
+					d.mu.Lock()
+					defer d.mu.Unlock()
+					d.added(session)
+				}()
+			}
+			best := d.sessions[0]
+			for _, s := range d.sessions[1:] {
+				if s.NumStreams() < best.NumStreams() {
+					best = s
+				}
+			}
+			return best, nil
+		}
+		// Every session is still being dialed.
+		d.ready.Wait()
+	}
+}
+
+// added ends a dial that returned session, or nil if it failed. d.mu must
+// be held.
+func (d *MuxDialer) added(session *yamux.Session) {
+	d.dialing--
+	if session != nil {
+		d.sessions = append(d.sessions, session)
+	}
+	d.ready.Broadcast()
+}
+
+// drop stops handing out session for new streams.
+func (d *MuxDialer) drop(session *yamux.Session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, s := range d.sessions {
+		if s == session {
+			d.sessions = append(d.sessions[:i], d.sessions[i+1:]...)
+			break
+		}
+	}
+}
+
+func (d *MuxDialer) dial() (*yamux.Session, error) {
+	conn, err := d.Dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(MuxHeader); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Send mux header failed: %s", err)
+	}
+	session, err := yamux.Client(conn, MuxConfig(d.KeepAlive))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Debugf("Opened mux session to %s", conn.RemoteAddr())
+	return session, nil
+}
+
+// MuxStream is a yamux stream that Pipe can half-close. Since yamux 0.1.2
+// Close only ends writing, and reading goes on until the other end closes
+// too.
+type MuxStream struct {
+	*yamux.Stream
+}
+
+func (s *MuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// logWriter passes yamux log lines on to our logger.
+type logWriter struct{}
+
+func (logWriter) Write(b []byte) (int, error) {
+	log.Debugf("yamux: %s", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
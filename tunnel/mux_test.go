@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// muxServer accepts mux connections and answers each stream with the
+// length of what it read once the client closed writing.
+type muxServer struct {
+	ln    net.Listener
+	dials chan struct{}
+}
+
+func newMuxServer(t *testing.T) *muxServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &muxServer{ln: ln, dials: make(chan struct{}, 100)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *muxServer) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, len(MuxHeader))
+	if _, err := io.ReadFull(conn, header); err != nil || !bytes.Equal(header, MuxHeader) {
+		return
+	}
+	session, err := yamux.Server(conn, MuxConfig(0))
+	if err != nil {
+		return
+	}
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			data, _ := ioutil.ReadAll(stream)
+			stream.Write([]byte{byte(len(data))})
+		}()
+	}
+}
+
+// Dial makes a connection to the server once a value is sent on dials.
+func (s *muxServer) Dial() (net.Conn, error) {
+	<-s.dials
+	return net.Dial("tcp", s.ln.Addr().String())
+}
+
+func TestMuxStreamCloseWrite(t *testing.T) {
+	s := newMuxServer(t)
+	s.dials <- struct{}{}
+	d := &MuxDialer{Dialer: s, Sessions: 1}
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{5}) {
+		t.Errorf("read %v after half-closing, want [5]", data)
+	}
+}
+
+func TestMuxDialerDialsOutsideLock(t *testing.T) {
+	s := newMuxServer(t)
+	d := &MuxDialer{Dialer: s, Sessions: 2}
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, 4)
+	for i := 0; i < cap(conns); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := d.Dial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns <- conn
+		}()
+	}
+	// Both sessions are dialed at once, which could not happen if the
+	// dialer held its lock while dialing.
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.dialing == 2
+	})
+	s.dials <- struct{}{}
+	s.dials <- struct{}{}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		conn.Close()
+	}
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.dialing == 0 && len(d.sessions) == 2
+	})
+}
+
+func TestMuxDialerDropsSession(t *testing.T) {
+	s := newMuxServer(t)
+	s.dials <- struct{}{}
+	s.dials <- struct{}{}
+	d := &MuxDialer{Dialer: s, Sessions: 1}
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := d.sessions[0]
+	d.drop(session)
+	if session.IsClosed() {
+		t.Fatal("dropping a session closed its streams")
+	}
+	other, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if len(d.sessions) != 1 || d.sessions[0] == session {
+		t.Error("dropped session still used")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Plugin is the SIP003 environment shadowsocks starts a plugin with.
+type Plugin struct {
+	LocalHost  string
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
+	Options    string
+}
+
+// LoadPlugin reads the SS_* environment variables.
+func LoadPlugin() *Plugin {
+	return &Plugin{
+		LocalHost:  unbracket(os.Getenv("SS_LOCAL_HOST")),
+		LocalPort:  os.Getenv("SS_LOCAL_PORT"),
+		RemoteHost: unbracket(os.Getenv("SS_REMOTE_HOST")),
+		RemotePort: os.Getenv("SS_REMOTE_PORT"),
+		Options:    os.Getenv("SS_PLUGIN_OPTIONS"),
+	}
+}
+
+// unbracket strips the brackets some launchers put around IPv6 literals.
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+func (p *Plugin) LocalAddress() string {
+	return net.JoinHostPort(p.LocalHost, p.LocalPort)
+}
+
+func (p *Plugin) RemoteAddress() string {
+	return net.JoinHostPort(p.RemoteHost, p.RemotePort)
+}
+
+// ServerName returns the host of address, which may lack a port, if it is a
+// host name rather than an IP literal, so it can be used as the TLS server
+// name.
+func ServerName(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// Options are parsed plugin options. A flag given without a value, such as
+// __android_vpn, maps to "".
+type Options map[string]string
+
+// commonAliases apply to every binary. shadowsocks-android appends the
+// __android_vpn flag when it runs in VPN mode.
+var commonAliases = map[string]string{
+	"__android_vpn": "Mode",
+	"vpn":           "Mode",
+}
+
+// ParseOptions parses SS_PLUGIN_OPTIONS as described by SIP003: key=value
+// pairs or bare flags separated by ";", where a backslash escapes the next
+// character so that keys and values may contain ";", "=" or "\\". Keys
+// found in aliases, or in the aliases every binary shares, are renamed to
+// their canonical key. When a key is given twice the last one wins.
+func ParseOptions(option string, aliases map[string]string) Options {
+	options := make(Options)
+	for _, pair := range splitEscaped(option, ';', -1) {
+		kv := splitEscaped(pair, '=', 2)
+		key := unescape(kv[0])
+		if key == "" {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = unescape(kv[1])
+		}
+		options.set(key, value, aliases)
+	}
+	return options
+}
+
+// set stores value under the canonical name of key.
+func (o Options) set(key, value string, aliases map[string]string) {
+	if canonical, ok := aliases[key]; ok {
+		key = canonical
+	} else if canonical, ok := commonAliases[key]; ok {
+		key = canonical
+	}
+	o[key] = value
+}
+
+// splitEscaped splits s around unescaped sep into at most n parts, or all
+// of them if n < 0. The parts keep their escapes.
+func splitEscaped(s string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s) && n != len(parts)+1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// String2Bool reads a boolean option, anything but false, False or 0 is
+// true.
+func String2Bool(input string) bool {
+	switch input {
+	case "false":
+		return false
+	case "0":
+		return false
+	case "False":
+		return false
+	default:
+		return true
+	}
+}
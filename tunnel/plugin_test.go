@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	aliases := map[string]string{"host": "domain", "h": "domain"}
+	tests := []struct {
+		options string
+		want    Options
+	}{
+		{"", Options{}},
+		// The examples of SIP003.
+		{"obfs=http;obfs-host=www.bing.com", Options{"obfs": "http", "obfs-host": "www.bing.com"}},
+		{`server;cert=/path/to/cert;key=/path/to/key`, Options{"server": "", "cert": "/path/to/cert", "key": "/path/to/key"}},
+		// Escaped separators and backslashes.
+		{`path=a\;b;x=1`, Options{"path": "a;b", "x": "1"}},
+		{`k\=ey=v\=al`, Options{"k=ey": "v=al"}},
+		{`dir=C:\\tls\\;n=2`, Options{"dir": `C:\tls\`, "n": "2"}},
+		{`token=a=b`, Options{"token": "a=b"}},
+		{`trailing=x\`, Options{"trailing": `x\`}},
+		// Bare flags, empty values and empty pairs.
+		{"mux;fast-open=;;", Options{"mux": "", "fast-open": ""}},
+		{"=orphan;a=1", Options{"a": "1"}},
+		// Aliases, per binary and shared, with the last value winning.
+		{"host=a.com;h=b.com", Options{"domain": "b.com"}},
+		{"__android_vpn", Options{"Mode": ""}},
+		{"vpn=true;domain=c.com", Options{"Mode": "true", "domain": "c.com"}},
+	}
+	for _, test := range tests {
+		if got := ParseOptions(test.options, aliases); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseOptions(%q) = %q, want %q", test.options, got, test.want)
+		}
+	}
+}
+
+func TestServerName(t *testing.T) {
+	for address, want := range map[string]string{
+		"example.com":       "example.com",
+		"example.com:443":   "example.com",
+		"192.0.2.1:443":     "",
+		"[2001:db8::1]:443": "",
+		"2001:db8::1":       "",
+	} {
+		if got := ServerName(address); got != want {
+			t.Errorf("ServerName(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPoolIdle is how long a PoolDialer keeps a connection waiting
+// unless told otherwise. It should stay below the idle timeouts of the
+// server and whatever sits behind it.
+const DefaultPoolIdle = 30 * time.Second
+
+// PoolDialer keeps up to Idle connections of Dialer dialed ahead, so Dial
+// usually returns one without waiting for a handshake. Connections nobody
+// took within MaxIdle are closed and replaced.
+type PoolDialer struct {
+	Dialer  Dialer
+	Idle    int
+	MaxIdle time.Duration
+
+	initOnce  sync.Once
+	startOnce sync.Once
+	closeOnce sync.Once
+	ready     chan net.Conn
+	closed    chan struct{}
+	fills     sync.WaitGroup
+}
+
+func (d *PoolDialer) Dial() (net.Conn, error) {
+	d.startOnce.Do(d.start)
+	select {
+	case conn := <-d.ready:
+		return conn, nil
+	default:
+		return d.Dialer.Dial()
+	}
+}
+
+// Close stops dialing ahead and closes the connections waiting for Dial.
+// Dial keeps working, without the pool.
+func (d *PoolDialer) Close() error {
+	d.initOnce.Do(d.init)
+	d.closeOnce.Do(func() { close(d.closed) })
+	d.fills.Wait()
+	return nil
+}
+
+func (d *PoolDialer) init() {
+	d.ready = make(chan net.Conn)
+	d.closed = make(chan struct{})
+}
+
+func (d *PoolDialer) start() {
+	d.initOnce.Do(d.init)
+	for i := 0; i < d.Idle; i++ {
+		d.fills.Add(1)
+		go d.fill()
+	}
+}
+
+// fill keeps one connection waiting for Dial at a time, until Close.
+func (d *PoolDialer) fill() {
+	defer d.fills.Done()
+	maxIdle := d.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = DefaultPoolIdle
+	}
+	backoff := time.Second
+	for {
+		select {
+		case <-d.closed:
+			return
+		default:
+		}
+		conn, err := d.Dialer.Dial()
+		if err != nil {
+			log.Debugf("Dial idle connection failed: %s", err)
+			select {
+			case <-d.closed:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxIdle {
+				backoff = maxIdle
+			}
+			continue
+		}
+		backoff = time.Second
+		expire := time.NewTimer(maxIdle)
+		select {
+		case d.ready <- conn:
+			expire.Stop()
+		case <-expire.C:
+			conn.Close()
+		case <-d.closed:
+			expire.Stop()
+			conn.Close()
+			return
+		}
+	}
+}
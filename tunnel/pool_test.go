@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials pipes whose other ends it keeps, counting the dials.
+type pipeDialer struct {
+	mu    sync.Mutex
+	peers []net.Conn
+}
+
+func (d *pipeDialer) Dial() (net.Conn, error) {
+	a, b := net.Pipe()
+	d.mu.Lock()
+	d.peers = append(d.peers, b)
+	d.mu.Unlock()
+	return a, nil
+}
+
+func (d *pipeDialer) dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.peers)
+}
+
+// closed reports whether the connection of peer was closed.
+func closed(peer net.Conn) bool {
+	peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := peer.Read(make([]byte, 1))
+	return err != nil && !isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func waitDials(t *testing.T, d *pipeDialer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.dials() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dials, want %d", d.dials(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolDialer(t *testing.T) {
+	dialer := &pipeDialer{}
+	d := &PoolDialer{Dialer: dialer, Idle: 2}
+	if _, err := d.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	// The first Dial starts the pool, two connections wait after it.
+	waitDials(t, dialer, 3)
+	time.Sleep(50 * time.Millisecond)
+	if n := dialer.dials(); n != 3 {
+		t.Errorf("%d dials with two waiting, want 3", n)
+	}
+
+	// A waiting connection is handed out and replaced.
+	if _, err := d.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	waitDials(t, dialer, 4)
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dials := dialer.dials()
+	// The two connections handed out stay open, the waiting ones not.
+	n := 0
+	for _, peer := range dialer.peers {
+		if closed(peer) {
+			n++
+		}
+	}
+	if n != dials-2 {
+		t.Errorf("%d of %d connections closed, want %d", n, dials, dials-2)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := dialer.dials(); n != dials {
+		t.Errorf("pool dialed %d more after Close", n-dials)
+	}
+	// Without the pool, Dial dials.
+	if _, err := d.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	if n := dialer.dials(); n != dials+1 {
+		t.Errorf("%d dials, want %d", n, dials+1)
+	}
+}
+
+func TestPoolDialerCloseUnused(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		(&PoolDialer{Dialer: &pipeDialer{}, Idle: 2}).Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close of an unused pool did not return")
+	}
+}
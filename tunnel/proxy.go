@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"net"
+)
+
+// ProxyClient tunnels connections through an HTTP proxy at Host:Port, with
+// a CONNECT request to RemoteHost:RemotePort that authenticates with Id and
+// Key in a way particular to the proxy.
+type ProxyClient struct {
+	Client
+	Host       string
+	Port       string
+	Id         string
+	Key        string
+	RemoteHost string
+	RemotePort string
+}
+
+// Init loads the plugin options and dials through the proxy, adding the
+// header fields auth makes from them to the CONNECT request.
+func (s *ProxyClient) Init(auth func(*ProxyClient) []HeaderField) *ProxyClient {
+	plugin := LoadPlugin()
+	s.Client.Init()
+	s.ListenAddress = plugin.LocalAddress()
+	s.RemoteHost = plugin.RemoteHost
+	s.RemotePort = plugin.RemotePort
+	s.LoadOption(ParseOptions(plugin.Options, proxyOptionAliases))
+	s.Dialer = &ConnectDialer{
+		Address: net.JoinHostPort(s.Host, s.Port),
+		Target:  net.JoinHostPort(s.RemoteHost, s.RemotePort),
+		Header:  append([]HeaderField{{Name: "Proxy-Connection", Value: "keep-alive"}}, auth(s)...),
+	}
+	return s
+}
+
+// proxyOptionAliases accepts the dashed spelling of the option names.
+var proxyOptionAliases = map[string]string{
+	"proxy-host":  "host",
+	"proxy-port":  "port",
+	"remote-host": "remotehost",
+	"remote-port": "remoteport",
+}
+
+func (s *ProxyClient) LoadOption(options Options) {
+	for key, value := range options {
+		switch key {
+		case "host":
+			s.Host = value
+		case "port":
+			s.Port = value
+		case "id":
+			s.Id = value
+		case "key":
+			s.Key = value
+		case "remotehost":
+			s.RemoteHost = value
+		case "remoteport":
+			s.RemotePort = value
+		default:
+			s.SetOption(key, value)
+		}
+	}
+}
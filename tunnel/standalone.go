@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Standalone is how a binary runs when it is started on its own rather than
+// by shadowsocks: a plain TCP over TLS tunnel from Listen to Backend.
+type Standalone struct {
+	Listen  string `yaml:"Listen"`
+	Backend string `yaml:"Backend"`
+	// Domain, Cert and Key are the options of the same name, Options holds
+	// any other plugin option.
+	Domain  string  `yaml:"Domain"`
+	Cert    string  `yaml:"Cert"`
+	Key     string  `yaml:"Key"`
+	Options Options `yaml:"Options"`
+}
+
+// Launched reports whether shadowsocks started the binary as a SIP003
+// plugin.
+func Launched() bool {
+	return os.Getenv("SS_LOCAL_PORT") != "" && os.Getenv("SS_REMOTE_PORT") != ""
+}
+
+// LoadStandalone reads the -config file, if any, and overrides it with the
+// other command line flags. Option keys are canonicalized with aliases like
+// ParseOptions does, and Domain, Cert and Key are copied into Options.
+func LoadStandalone(aliases map[string]string) (*Standalone, error) {
+	config := flag.String("config", "", "JSON or YAML config file.")
+	listen := flag.String("listen", "", "Address to listen on.")
+	backend := flag.String("backend", "", "Address to forward connections to.")
+	domain := flag.String("domain", "", "TLS server name.")
+	cert := flag.String("cert", "", "TLS certificate file.")
+	key := flag.String("key", "", "TLS private key file.")
+	options := flag.String("options", "", "Further options in SS_PLUGIN_OPTIONS syntax.")
+	flag.Parse()
+
+	s := &Standalone{}
+	if *config != "" {
+		if err := s.load(*config); err != nil {
+			return nil, fmt.Errorf("load %s: %s", *config, err)
+		}
+	}
+	for _, f := range []struct{ flag, field *string }{
+		{listen, &s.Listen},
+		{backend, &s.Backend},
+		{domain, &s.Domain},
+		{cert, &s.Cert},
+		{key, &s.Key},
+	} {
+		if *f.flag != "" {
+			*f.field = *f.flag
+		}
+	}
+	if s.Listen == "" || s.Backend == "" {
+		return nil, errors.New("not started as a plugin, -listen and -backend or a -config file are required")
+	}
+
+	o := make(Options)
+	for k, v := range s.Options {
+		o.set(k, v, aliases)
+	}
+	for k, v := range ParseOptions(*options, aliases) {
+		o[k] = v
+	}
+	for k, v := range map[string]string{"domain": s.Domain, "cert": s.Cert, "key": s.Key} {
+		if v != "" {
+			o[k] = v
+		}
+	}
+	s.Options = o
+	return s, nil
+}
+
+func (s *Standalone) load(path string) error {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(f, s)
+	default:
+		return json.Unmarshal(f, s)
+	}
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadCertPool reads a file of PEM encoded CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// VerifyClient checks that certs, as presented by a TLS client, form a
+// chain to a CA in roots valid for client authentication.
+func VerifyClient(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// ServerCheck is how a client verifies the server it connects to.
+type ServerCheck struct {
+	// Name is what the certificate must be valid for, a host name or an IP.
+	// Roots, if set, replace the system roots.
+	Name  string
+	Roots *x509.CertPool
+	// Pins are SHA-256 hashes of public keys, see ParsePins. If set, a
+	// certificate of the verified chain must have one of them.
+	Pins [][]byte
+	// Insecure skips verifying the chain and the name, for testing only.
+	// Pins are still checked against the certificates the server sent.
+	Insecure bool
+}
+
+// Apply makes config verify servers with c instead of the default
+// verification.
+func (c *ServerCheck) Apply(config *tls.Config) {
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = c.verify
+	// A server refusing ECH answers for its public name instead, which the
+	// TLS stack checks against the roots before trusting its retry configs.
+	config.RootCAs = c.Roots
+}
+
+func (c *ServerCheck) verify(state tls.ConnectionState) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	candidates := certs
+	if !c.Insecure {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       c.Name,
+			Roots:         c.Roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+		candidates = nil
+		for _, chain := range chains {
+			candidates = append(candidates, chain...)
+		}
+	}
+	if len(c.Pins) == 0 {
+		return nil
+	}
+	for _, cert := range candidates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range c.Pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no pinned public key in the server certificate chain")
+}
+
+// ParsePins parses comma separated SHA-256 hashes of DER encoded
+// SubjectPublicKeyInfo, in base64 as HPKP pin-sha256 values or in hex.
+func ParsePins(value string) ([][]byte, error) {
+	var pins [][]byte
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "sha256/"))
+		if s == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(s)
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(s)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q", s)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
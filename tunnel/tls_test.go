@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert makes a certificate for names signed by parent, or a CA signing
+// itself if parent is nil.
+func testCert(t *testing.T, parent *tls.Certificate, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func pin(cert tls.Certificate) []byte {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+func TestServerCheck(t *testing.T) {
+	ca := testCert(t, nil)
+	otherCA := testCert(t, nil)
+	server := testCert(t, &ca, "tunnel.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA.Leaf)
+
+	tests := []struct {
+		name  string
+		sni   string
+		check ServerCheck
+		// fail is part of the error the handshake fails with, if it fails.
+		fail string
+	}{
+		{"verified", "tunnel.example.com", ServerCheck{Name: "tunnel.example.com", Roots: roots}, ""},
+		{"wrong CA", "tunnel.example.com", ServerCheck{Name: "tunnel.example.com", Roots: otherRoots}, "unknown authority"},
+		{"wrong name", "tunnel.example.com", ServerCheck{Name: "other.example.com", Roots: roots}, "not other.example.com"},
+		// The name sent does not matter, only the one checked.
+		{"sni differs from domain", "cdn.example.net", ServerCheck{Name: "tunnel.example.com", Roots: roots}, ""},
+		{"leaf pin", "tunnel.example.com", ServerCheck{Name: "tunnel.example.com", Roots: roots, Pins: [][]byte{pin(server)}}, ""},
+		{"CA pin", "tunnel.example.com", ServerCheck{Name: "tunnel.example.com", Roots: roots, Pins: [][]byte{pin(ca)}}, ""},
+		{"pin mismatch", "tunnel.example.com", ServerCheck{Name: "tunnel.example.com", Roots: roots, Pins: [][]byte{pin(otherCA)}}, "no pinned public key"},
+		{"insecure", "x", ServerCheck{Name: "other.example.com", Roots: otherRoots, Insecure: true}, ""},
+		{"insecure pin", "x", ServerCheck{Name: "other.example.com", Insecure: true, Pins: [][]byte{pin(server)}}, ""},
+		{"insecure pin mismatch", "x", ServerCheck{Name: "other.example.com", Insecure: true, Pins: [][]byte{pin(ca)}}, "no pinned public key"},
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &tls.Config{ServerName: test.sni}
+			test.check.Apply(config)
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			conn, err := tls.DialWithDialer(dialer, "tcp", ln.Addr().String(), config)
+			if err == nil {
+				conn.Close()
+			}
+			switch {
+			case test.fail == "" && err != nil:
+				t.Errorf("handshake failed: %s", err)
+			case test.fail != "" && err == nil:
+				t.Error("handshake succeeded")
+			case err != nil && !strings.Contains(err.Error(), test.fail):
+				t.Errorf("handshake failed with %q, want %q", err, test.fail)
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	pins, err := ParsePins(" sha256/LHDhK3oGRvkiefQnx7OOczTY5Tic/xZ6HcMOc/gmtoM=, 2c70e12b7a0646f92279f427c7b38e7334d8e5389cff167a1dc30e73f826b683,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || string(pins[0]) != string(sum[:]) || string(pins[1]) != string(sum[:]) {
+		t.Errorf("pins %x, want twice %x", pins, sum)
+	}
+	for _, value := range []string{"abc", "sha256/AAAA"} {
+		if _, err := ParsePins(value); err == nil {
+			t.Errorf("ParsePins(%q) succeeded", value)
+		}
+	}
+}